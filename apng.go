@@ -0,0 +1,341 @@
+package png
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// Dispose and blend operations, as per the APNG spec
+// (https://wiki.mozilla.org/APNG_Specification).
+const (
+	DisposeNone       = 0
+	DisposeBackground = 1
+	DisposePrevious   = 2
+
+	BlendSource = 0
+	BlendOver   = 1
+)
+
+// A FrameControl describes one animation frame's region within the image
+// canvas, its display duration, and how it composites onto the previous
+// frame, as per an fcTL chunk.
+type FrameControl struct {
+	SequenceNumber     uint32
+	Width, Height      int
+	XOffset, YOffset   int
+	DelayNum, DelayDen uint16
+	DisposeOp, BlendOp uint8
+}
+
+// parseFrameControl parses the 26-byte body of an fcTL chunk.
+func parseFrameControl(data []byte) (FrameControl, error) {
+	if len(data) != 26 {
+		return FrameControl{}, FormatError("bad fcTL length")
+	}
+	width := binary.BigEndian.Uint32(data[4:8])
+	height := binary.BigEndian.Uint32(data[8:12])
+	if width == 0 || height == 0 || width > 0x7fffffff || height > 0x7fffffff {
+		return FrameControl{}, FormatError("bad fcTL dimensions")
+	}
+	return FrameControl{
+		SequenceNumber: binary.BigEndian.Uint32(data[0:4]),
+		Width:          int(width),
+		Height:         int(height),
+		XOffset:        int(binary.BigEndian.Uint32(data[12:16])),
+		YOffset:        int(binary.BigEndian.Uint32(data[16:20])),
+		DelayNum:       binary.BigEndian.Uint16(data[20:22]),
+		DelayDen:       binary.BigEndian.Uint16(data[22:24]),
+		DisposeOp:      data[24],
+		BlendOp:        data[25],
+	}, nil
+}
+
+// Animation returns an AnimationController for an APNG, i.e. an image with
+// an acTL chunk, or ok=false for a plain, non-animated PNG.
+//
+// Animation must be called, if at all, before reading any rows with
+// DecodeRow, and AnimationController.NextFrame must not be interleaved with
+// further DecodeRow calls: frame 0 of the animation is the same pixels
+// DecodeRow itself already streams, read from the main IDAT stream, and
+// NextFrame's first call simply returns that frame's FrameControl without a
+// FrameDecoder.
+func (d *Decoder) Animation() (ac *AnimationController, ok bool) {
+	if !d.d.meta.hasActl {
+		return nil, false
+	}
+	return &AnimationController{dec: d}, true
+}
+
+// An AnimationController iterates the frames of an APNG on top of a
+// Decoder's row-streaming IDAT decode.
+type AnimationController struct {
+	dec    *Decoder
+	next   int
+	lastFR *fdatReader
+
+	finished bool
+}
+
+// NumFrames returns the number of animation frames, from the acTL chunk.
+func (ac *AnimationController) NumFrames() int { return int(ac.dec.d.meta.numFrames) }
+
+// NumPlays returns the number of times the animation repeats, from the
+// acTL chunk; 0 means infinite.
+func (ac *AnimationController) NumPlays() int { return int(ac.dec.d.meta.numPlays) }
+
+// NextFrame advances to the next animation frame, returning io.EOF once
+// NumFrames frames have been returned. For frame 0, when it is the same
+// image DecodeRow streams, it returns that frame's FrameControl with a nil
+// FrameDecoder. For every other frame, it returns a FrameDecoder whose
+// DecodeRow streams that frame's own Width by Height pixels, in the same
+// source color type and bit depth as the main image.
+//
+// Frames are not interlaced even if the main image is, since the APNG
+// extension makes no provision for interlaced fdAT data; NextFrame returns
+// an UnsupportedError if the image itself is interlaced and more than one
+// frame is requested.
+func (ac *AnimationController) NextFrame() (FrameControl, *FrameDecoder, error) {
+	dd := ac.dec.d
+	if ac.next >= int(dd.meta.numFrames) {
+		if err := ac.finish(); err != nil {
+			return FrameControl{}, nil, err
+		}
+		return FrameControl{}, nil, io.EOF
+	}
+	if ac.next == 0 && dd.meta.hasFrame0Ctl {
+		ac.next++
+		return dd.meta.frame0Ctl, nil, nil
+	}
+	if dd.interlace != 0 {
+		return FrameControl{}, nil, UnsupportedError("animation of an interlaced image")
+	}
+
+	if ac.next == 0 {
+		// No fcTL precedes IDAT, so the default image is a plain fallback
+		// that is not itself an animation frame (a common pattern for
+		// viewers that don't understand APNG). The caller never had a
+		// reason to drain it via DecodeRow, so drain it ourselves before
+		// closing the IDAT stream, or its unread compressed bytes would
+		// leave the stream mid-deflate-block and fail the checksum check
+		// below for no reason the caller could see coming.
+		for ac.dec.y < dd.height {
+			if _, err := ac.dec.DecodeRow(); err != nil {
+				return FrameControl{}, nil, err
+			}
+		}
+	}
+
+	if err := ac.dec.closeIDAT(); err != nil {
+		return FrameControl{}, nil, err
+	}
+	typ, length, err := ac.nextChunkHeader()
+	if err != nil {
+		return FrameControl{}, nil, err
+	}
+	if typ != "fcTL" {
+		return FrameControl{}, nil, FormatError("expected fcTL, got " + typ)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(dd.r, data); err != nil {
+		return FrameControl{}, nil, err
+	}
+	dd.crc.Write(data)
+	if err := dd.verifyChecksum(); err != nil {
+		return FrameControl{}, nil, err
+	}
+	ctl, err := parseFrameControl(data)
+	if err != nil {
+		return FrameControl{}, nil, err
+	}
+
+	fr := &fdatReader{d: dd}
+	zr, err := zlib.NewReader(fr)
+	if err != nil {
+		return FrameControl{}, nil, err
+	}
+	fd, err := newFrameDecoder(dd, fr, zr, ac.dec.bitsPerPixel, ac.dec.bytesPerPixel, ctl.Width, ctl.Height)
+	if err != nil {
+		return FrameControl{}, nil, err
+	}
+	ac.lastFR = fr
+	ac.next++
+	return ctl, fd, nil
+}
+
+// finish reads and checks the final IEND chunk, idempotently, so that
+// iterating an AnimationController to completion leaves the stream in the
+// same state Decoder.Close would.
+func (ac *AnimationController) finish() error {
+	if ac.finished {
+		return nil
+	}
+	ac.finished = true
+	if err := ac.dec.closeIDAT(); err != nil {
+		return err
+	}
+	typ, length, err := ac.nextChunkHeader()
+	if err != nil {
+		return err
+	}
+	if typ != "IEND" || length != 0 {
+		return FormatError("expected IEND")
+	}
+	if err := ac.dec.d.verifyChecksum(); err != nil {
+		return err
+	}
+	ac.dec.d.stage = dsSeenIEND
+	return nil
+}
+
+// nextChunkHeader returns the type and length of the next chunk, either one
+// already peeked by the previous frame's fdatReader, or freshly read from
+// the stream, resetting the running checksum for it either way.
+func (ac *AnimationController) nextChunkHeader() (string, uint32, error) {
+	dd := ac.dec.d
+	var typ string
+	var length uint32
+	if ac.lastFR != nil && ac.lastFR.atBoundary {
+		typ, length = ac.lastFR.peekTyp, ac.lastFR.peekLen
+	} else {
+		var hdr [8]byte
+		if _, err := io.ReadFull(dd.r, hdr[:]); err != nil {
+			return "", 0, err
+		}
+		length = binary.BigEndian.Uint32(hdr[:4])
+		typ = string(hdr[4:8])
+	}
+	dd.crc.Reset()
+	dd.crc.Write([]byte(typ))
+	return typ, length, nil
+}
+
+// fdatReader presents the fdAT chunks of one APNG frame as one continuous
+// stream, analogous to decoder.Read for IDAT chunks, but stripping each
+// fdAT chunk's leading 4-byte sequence number. It stops, without consuming
+// the next chunk's body, as soon as it reads a chunk header that is not
+// "fdAT", recording that header in peekTyp/peekLen for the caller.
+type fdatReader struct {
+	d       *decoder
+	left    uint32
+	started bool
+
+	atBoundary bool
+	peekTyp    string
+	peekLen    uint32
+}
+
+func (fr *fdatReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for fr.left == 0 {
+		if fr.atBoundary {
+			return 0, io.EOF
+		}
+		if fr.started {
+			if err := fr.d.verifyChecksum(); err != nil {
+				return 0, err
+			}
+		}
+		var hdr [8]byte
+		if _, err := io.ReadFull(fr.d.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(hdr[:4])
+		typ := string(hdr[4:8])
+		if typ != "fdAT" {
+			fr.atBoundary = true
+			fr.peekTyp = typ
+			fr.peekLen = length
+			return 0, io.EOF
+		}
+		if length < 4 {
+			return 0, FormatError("bad fdAT length")
+		}
+		fr.d.crc.Reset()
+		fr.d.crc.Write(hdr[4:8])
+		var seq [4]byte
+		if _, err := io.ReadFull(fr.d.r, seq[:]); err != nil {
+			return 0, err
+		}
+		fr.d.crc.Write(seq[:])
+		fr.left = length - 4
+		fr.started = true
+	}
+	n, err := fr.d.r.Read(p[:min(len(p), int(fr.left))])
+	fr.d.crc.Write(p[:n])
+	fr.left -= uint32(n)
+	return n, err
+}
+
+// A FrameDecoder is a row-by-row decoder for one APNG animation frame,
+// analogous to Decoder but sized to the frame's own Width and Height rather
+// than the full image canvas.
+type FrameDecoder struct {
+	dd            *decoder
+	fr            *fdatReader
+	zr            io.ReadCloser
+	bytesPerPixel int
+	width, height int
+	y             int
+	cr, pr, row   []uint8
+}
+
+func newFrameDecoder(dd *decoder, fr *fdatReader, zr io.ReadCloser, bitsPerPixel, bytesPerPixel, width, height int) (*FrameDecoder, error) {
+	rowSize := 1 + (int64(bitsPerPixel)*int64(width)+7)/8
+	if rowSize != int64(int(rowSize)) {
+		return nil, UnsupportedError("dimension overflow")
+	}
+	return &FrameDecoder{
+		dd:            dd,
+		fr:            fr,
+		zr:            zr,
+		bytesPerPixel: bytesPerPixel,
+		width:         width,
+		height:        height,
+		cr:            make([]uint8, rowSize),
+		pr:            make([]uint8, rowSize),
+		row:           make([]uint8, width*4),
+	}, nil
+}
+
+// DecodeRow decodes the frame's current row and returns it as NRGBA bytes,
+// the same way Decoder.DecodeRow does for the main image.
+func (fd *FrameDecoder) DecodeRow() ([]byte, error) {
+	if fd.y >= fd.height {
+		return nil, io.EOF
+	}
+	cdat, err := reconstructRow(fd.zr, fd.cr, fd.pr, fd.bytesPerPixel)
+	if err != nil {
+		return nil, err
+	}
+	fd.dd.convertRow(cdat, fd.width, func(x int, r, g, b, a uint8) {
+		o := 4 * x
+		fd.row[o], fd.row[o+1], fd.row[o+2], fd.row[o+3] = r, g, b, a
+	})
+	fd.pr, fd.cr = fd.cr, fd.pr
+	fd.y++
+	return fd.row, nil
+}
+
+// Close finishes reading the frame's compressed data, verifying its zlib
+// checksum and every fdAT chunk's CRC, and leaves the underlying chunk
+// stream positioned at the next chunk's header. It must be called, after
+// draining any unread rows, before AnimationController.NextFrame is called
+// again.
+func (fd *FrameDecoder) Close() error {
+	if err := fd.zr.Close(); err != nil {
+		return err
+	}
+	// zlib.Reader may satisfy its own Adler-32 check from bytes it has
+	// already buffered, without calling fr.Read again, so fr can be left
+	// positioned mid-chunk (its last fdAT's CRC unread) even once zr.Close
+	// returns. Draining fr itself (not fd.zr) forces every remaining byte,
+	// including that trailing CRC, to be read and checked, and leaves fr
+	// holding the next chunk's peeked header for AnimationController.
+	if _, err := io.Copy(io.Discard, fd.fr); err != nil {
+		return err
+	}
+	return nil
+}
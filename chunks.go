@@ -0,0 +1,459 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+)
+
+// A ChunkHandler observes ancillary PNG chunks that NewDecoder does not
+// itself need in order to decode pixels. HandleChunk is called once per
+// ancillary chunk, in file order, with the chunk's raw (decompressed-as-is)
+// data, including chunk types NewDecoder has no built-in parser for. It is
+// also called for chunks NewDecoder does parse into the typed accessors
+// below (e.g. tEXt, pHYs), so a handler can always get at the raw bytes even
+// for a chunk type it also has built-in support for.
+type ChunkHandler interface {
+	HandleChunk(typ [4]byte, data []byte) error
+}
+
+// WithChunkHandler registers a ChunkHandler with NewDecoder. Multiple
+// handlers may be registered; they run in registration order.
+func WithChunkHandler(h ChunkHandler) DecoderOption {
+	return func(o *decoderOptions) { o.chunkHandlers = append(o.chunkHandlers, h) }
+}
+
+// Chromaticities holds the CIE 1931 xy chromaticity values from a cHRM
+// chunk.
+type Chromaticities struct {
+	WhiteX, WhiteY float64
+	RedX, RedY     float64
+	GreenX, GreenY float64
+	BlueX, BlueY   float64
+}
+
+// PhysicalPixelDimensions holds the pixel density from a pHYs chunk.
+type PhysicalPixelDimensions struct {
+	PixelsPerUnitX, PixelsPerUnitY uint32
+	// Unit is 0 if the pixel density is of unspecified units, or 1 if
+	// PixelsPerUnitX and PixelsPerUnitY are pixels per meter.
+	Unit uint8
+}
+
+// A TextEntry is one tEXt, zTXt or iTXt chunk's keyword/text pair. Language
+// and TranslatedKeyword are only ever set by iTXt chunks that carry a
+// language tag; they are empty for tEXt and zTXt entries.
+type TextEntry struct {
+	Keyword           string
+	Text              string
+	Language          string
+	TranslatedKeyword string
+}
+
+// meta holds the ancillary chunk data NewDecoder's built-in handlers
+// accumulate as they scan past IHDR, surfaced through the typed accessor
+// methods on Decoder below.
+type meta struct {
+	hasGamma bool
+	gamma    float64
+
+	hasChroma bool
+	chroma    Chromaticities
+
+	hasICCProfile bool
+	iccName       string
+	iccProfile    []byte
+
+	hasPhys bool
+	phys    PhysicalPixelDimensions
+
+	text []TextEntry
+
+	exif []byte
+
+	hasActl   bool
+	numFrames uint32
+	numPlays  uint32
+
+	hasFrame0Ctl bool
+	frame0Ctl    FrameControl
+}
+
+// Gamma returns the image gamma from a gAMA chunk, and whether one was
+// present.
+func (d *Decoder) Gamma() (gamma float64, ok bool) {
+	return d.d.meta.gamma, d.d.meta.hasGamma
+}
+
+// Chromaticities returns the reference white point and primary chromaticity
+// values from a cHRM chunk, and whether one was present.
+func (d *Decoder) Chromaticities() (Chromaticities, bool) {
+	return d.d.meta.chroma, d.d.meta.hasChroma
+}
+
+// ICCProfile returns the decompressed ICC profile and its name from an iCCP
+// chunk, and whether one was present.
+func (d *Decoder) ICCProfile() (name string, profile []byte, ok bool) {
+	return d.d.meta.iccName, d.d.meta.iccProfile, d.d.meta.hasICCProfile
+}
+
+// PhysicalPixelDimensions returns the pixel density from a pHYs chunk, and
+// whether one was present.
+func (d *Decoder) PhysicalPixelDimensions() (PhysicalPixelDimensions, bool) {
+	return d.d.meta.phys, d.d.meta.hasPhys
+}
+
+// Text returns the tEXt, zTXt and iTXt entries seen so far, in file order.
+// Since these chunks may legally appear after the IDAT chunks, a caller
+// wanting the complete set should call Text after Close, not just after
+// NewDecoder.
+func (d *Decoder) Text() []TextEntry {
+	return d.d.meta.text
+}
+
+// EXIF returns the raw TIFF-format payload of an eXIf chunk, and whether
+// one was present.
+func (d *Decoder) EXIF() (data []byte, ok bool) {
+	return d.d.meta.exif, d.d.meta.exif != nil
+}
+
+// ancillaryFixedLength holds the exact body length of every ancillary chunk
+// type parseAncillary knows to be fixed-size. Checking a chunk against it
+// before allocating a buffer means a hostile chunk claiming a huge length
+// for a type that can never actually need one is rejected up front, rather
+// than after paying for the allocation.
+var ancillaryFixedLength = map[string]uint32{
+	"gAMA": 4,
+	"cHRM": 32,
+	"pHYs": 9,
+	"acTL": 8,
+	"fcTL": 26,
+}
+
+// maxVariableAncillaryLength bounds the raw body size of the ancillary
+// chunk types that have no fixed length (iCCP, tEXt, zTXt, iTXt, eXIf).
+// These are parsed unconditionally, regardless of whether any ChunkHandler
+// is registered, so unlike the unknown-chunk-type path in NewDecoder they
+// can't simply be skipped for a length a caller never asked to receive;
+// capping them instead stops a hostile chunk from forcing a huge allocation
+// merely by declaring one, while comfortably fitting any real ICC profile,
+// EXIF blob or text chunk.
+const maxVariableAncillaryLength = 32 << 20 // 32 MiB
+
+// parseAncillary reads and dispatches one ancillary chunk of the given
+// type and length: known types are parsed into d.meta, and every chunk,
+// known or not reaching this function, is offered to the registered
+// ChunkHandlers.
+func (d *decoder) parseAncillary(typ string, length uint32) error {
+	if length > 0x7fffffff {
+		return FormatError("bad chunk length")
+	}
+	if want, ok := ancillaryFixedLength[typ]; ok {
+		if length != want {
+			return FormatError("bad " + typ + " length")
+		}
+	} else if length > maxVariableAncillaryLength {
+		return FormatError("bad " + typ + " length")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return err
+	}
+	d.crc.Write(data)
+
+	var err error
+	switch typ {
+	case "gAMA":
+		err = d.parseGAMA(data)
+	case "cHRM":
+		err = d.parseCHRM(data)
+	case "iCCP":
+		err = d.parseICCP(data)
+	case "pHYs":
+		err = d.parsePHYS(data)
+	case "tEXt":
+		err = d.parseTEXT(data)
+	case "zTXt":
+		err = d.parseZTXT(data)
+	case "iTXt":
+		err = d.parseITXT(data)
+	case "eXIf":
+		d.meta.exif = data
+	case "acTL":
+		err = d.parseACTL(data)
+	case "fcTL":
+		err = d.parseFCTL(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.runChunkHandlers(typ, data); err != nil {
+		return err
+	}
+	return d.verifyChecksum()
+}
+
+// maxAncillaryDecompressedSize bounds how large iCCP, zTXt and iTXt chunks'
+// zlib-compressed payloads may decompress to, so that a small chunk can't
+// zlib-bomb its way to an enormous allocation.
+const maxAncillaryDecompressedSize = 16 << 20 // 16 MiB
+
+// readLimitedZlib reads all of zr, up to maxAncillaryDecompressedSize, and
+// errors if more remains after that.
+func readLimitedZlib(zr io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(zr, maxAncillaryDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAncillaryDecompressedSize {
+		return nil, FormatError("decompressed chunk too large")
+	}
+	return data, nil
+}
+
+// runChunkHandlers invokes every registered ChunkHandler with typ's data, in
+// registration order.
+func (d *decoder) runChunkHandlers(typ string, data []byte) error {
+	var t [4]byte
+	copy(t[:], typ)
+	for _, h := range d.chunkHandlers {
+		if err := h.HandleChunk(t, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseGAMA parses a gAMA chunk. Its length is validated by parseAncillary
+// before data is read, via ancillaryFixedLength.
+func (d *decoder) parseGAMA(data []byte) error {
+	d.meta.gamma = float64(binary.BigEndian.Uint32(data)) / 100000
+	d.meta.hasGamma = true
+	return nil
+}
+
+// parseCHRM parses a cHRM chunk. Its length is validated by parseAncillary
+// before data is read, via ancillaryFixedLength.
+func (d *decoder) parseCHRM(data []byte) error {
+	v := func(i int) float64 { return float64(binary.BigEndian.Uint32(data[4*i:])) / 100000 }
+	d.meta.chroma = Chromaticities{
+		WhiteX: v(0), WhiteY: v(1),
+		RedX: v(2), RedY: v(3),
+		GreenX: v(4), GreenY: v(5),
+		BlueX: v(6), BlueY: v(7),
+	}
+	d.meta.hasChroma = true
+	return nil
+}
+
+// parseICCP parses an iCCP chunk: a null-terminated profile name, a
+// one-byte compression method (always 0, for zlib/deflate), and the
+// zlib-compressed ICC profile.
+func (d *decoder) parseICCP(data []byte) error {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i > 79 || i+1 >= len(data) {
+		return FormatError("bad iCCP chunk")
+	}
+	if data[i+1] != 0 {
+		return UnsupportedError("iCCP compression method")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return FormatError("bad iCCP profile: " + err.Error())
+	}
+	profile, err := readLimitedZlib(zr)
+	if err != nil {
+		return FormatError("bad iCCP profile: " + err.Error())
+	}
+	d.meta.iccName = string(data[:i])
+	d.meta.iccProfile = profile
+	d.meta.hasICCProfile = true
+	return nil
+}
+
+// parsePHYS parses a pHYs chunk. Its length is validated by parseAncillary
+// before data is read, via ancillaryFixedLength.
+func (d *decoder) parsePHYS(data []byte) error {
+	d.meta.phys = PhysicalPixelDimensions{
+		PixelsPerUnitX: binary.BigEndian.Uint32(data[0:4]),
+		PixelsPerUnitY: binary.BigEndian.Uint32(data[4:8]),
+		Unit:           data[8],
+	}
+	d.meta.hasPhys = true
+	return nil
+}
+
+func (d *decoder) parseTEXT(data []byte) error {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 {
+		return FormatError("bad tEXt chunk")
+	}
+	d.meta.text = append(d.meta.text, TextEntry{Keyword: string(data[:i]), Text: string(data[i+1:])})
+	return nil
+}
+
+// parseZTXT parses a zTXt chunk: a null-terminated keyword, a one-byte
+// compression method (always 0), and the zlib-compressed text.
+func (d *decoder) parseZTXT(data []byte) error {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+1 >= len(data) {
+		return FormatError("bad zTXt chunk")
+	}
+	if data[i+1] != 0 {
+		return UnsupportedError("zTXt compression method")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data[i+2:]))
+	if err != nil {
+		return FormatError("bad zTXt text: " + err.Error())
+	}
+	text, err := readLimitedZlib(zr)
+	if err != nil {
+		return FormatError("bad zTXt text: " + err.Error())
+	}
+	d.meta.text = append(d.meta.text, TextEntry{Keyword: string(data[:i]), Text: string(text)})
+	return nil
+}
+
+// parseITXT parses an iTXt chunk: a null-terminated keyword, a one-byte
+// compression flag, a one-byte compression method, a null-terminated
+// language tag, a null-terminated translated keyword (both UTF-8), and
+// finally the text, optionally zlib-compressed.
+func (d *decoder) parseITXT(data []byte) error {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 >= len(data) {
+		return FormatError("bad iTXt chunk")
+	}
+	keyword := string(data[:i])
+	compressed := data[i+1] != 0
+	method := data[i+2]
+	rest := data[i+3:]
+
+	j := bytes.IndexByte(rest, 0)
+	if j < 0 {
+		return FormatError("bad iTXt chunk")
+	}
+	language := string(rest[:j])
+	rest = rest[j+1:]
+
+	k := bytes.IndexByte(rest, 0)
+	if k < 0 {
+		return FormatError("bad iTXt chunk")
+	}
+	translatedKeyword := string(rest[:k])
+	rest = rest[k+1:]
+
+	var text string
+	if compressed {
+		if method != 0 {
+			return UnsupportedError("iTXt compression method")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(rest))
+		if err != nil {
+			return FormatError("bad iTXt text: " + err.Error())
+		}
+		b, err := readLimitedZlib(zr)
+		if err != nil {
+			return FormatError("bad iTXt text: " + err.Error())
+		}
+		text = string(b)
+	} else {
+		text = string(rest)
+	}
+
+	d.meta.text = append(d.meta.text, TextEntry{
+		Keyword:           keyword,
+		Text:              text,
+		Language:          language,
+		TranslatedKeyword: translatedKeyword,
+	})
+	return nil
+}
+
+// parseACTL parses an acTL chunk. Its length is validated by parseAncillary
+// before data is read, via ancillaryFixedLength.
+func (d *decoder) parseACTL(data []byte) error {
+	d.meta.numFrames = binary.BigEndian.Uint32(data[0:4])
+	d.meta.numPlays = binary.BigEndian.Uint32(data[4:8])
+	d.meta.hasActl = true
+	return nil
+}
+
+// parseFCTL parses an fcTL chunk. It is only called here for the fcTL
+// chunk describing frame 0, which appears before IDAT; fcTL chunks for
+// later frames are parsed by AnimationController.NextFrame instead.
+func (d *decoder) parseFCTL(data []byte) error {
+	ctl, err := parseFrameControl(data)
+	if err != nil {
+		return err
+	}
+	d.meta.frame0Ctl = ctl
+	d.meta.hasFrame0Ctl = true
+	return nil
+}
+
+// writeAncillaryChunks writes the ancillary chunks requested by o's With*
+// options, in the order the PNG spec recommends they appear relative to
+// IHDR and IDAT: cHRM and gAMA before iCCP, then pHYs, then eXIf and tEXt.
+func writeAncillaryChunks(w io.Writer, o *rowEncoderOptions) error {
+	if o.chroma != nil {
+		c := o.chroma
+		var data [32]byte
+		vals := []float64{c.WhiteX, c.WhiteY, c.RedX, c.RedY, c.GreenX, c.GreenY, c.BlueX, c.BlueY}
+		for i, v := range vals {
+			binary.BigEndian.PutUint32(data[4*i:], uint32(v*100000+0.5))
+		}
+		if err := writeChunk(w, "cHRM", data[:]); err != nil {
+			return err
+		}
+	}
+	if o.gamma != nil {
+		var data [4]byte
+		binary.BigEndian.PutUint32(data[:], uint32(*o.gamma*100000+0.5))
+		if err := writeChunk(w, "gAMA", data[:]); err != nil {
+			return err
+		}
+	}
+	if o.iccProfile != nil {
+		if len(o.iccName) == 0 || len(o.iccName) > 79 || bytes.IndexByte([]byte(o.iccName), 0) >= 0 {
+			return FormatError("bad iCCP profile name")
+		}
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(o.iccProfile); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data := append([]byte(o.iccName), 0, 0)
+		data = append(data, buf.Bytes()...)
+		if err := writeChunk(w, "iCCP", data); err != nil {
+			return err
+		}
+	}
+	if o.phys != nil {
+		p := o.phys
+		var data [9]byte
+		binary.BigEndian.PutUint32(data[0:4], p.PixelsPerUnitX)
+		binary.BigEndian.PutUint32(data[4:8], p.PixelsPerUnitY)
+		data[8] = p.Unit
+		if err := writeChunk(w, "pHYs", data[:]); err != nil {
+			return err
+		}
+	}
+	if o.exif != nil {
+		if err := writeChunk(w, "eXIf", o.exif); err != nil {
+			return err
+		}
+	}
+	for _, t := range o.text {
+		data := append([]byte(t.Keyword), 0)
+		data = append(data, []byte(t.Text)...)
+		if err := writeChunk(w, "tEXt", data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
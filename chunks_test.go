@@ -0,0 +1,617 @@
+package png
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestAnimation(t *testing.T) {
+	want := [][]byte{
+		{0, 0, 0, 255, 10, 0, 0, 255, 20, 0, 0, 255, 30, 0, 0, 255, 40, 0, 0, 255, 50, 0, 0, 255,
+			0, 20, 0, 255, 10, 20, 0, 255, 20, 20, 0, 255, 30, 20, 0, 255, 40, 20, 0, 255, 50, 20, 0, 255,
+			0, 40, 0, 255, 10, 40, 0, 255, 20, 40, 0, 255, 30, 40, 0, 255, 40, 40, 0, 255, 50, 40, 0, 255,
+			0, 60, 0, 255, 10, 60, 0, 255, 20, 60, 0, 255, 30, 60, 0, 255, 40, 60, 0, 255, 50, 60, 0, 255},
+		{1, 1, 50, 255, 11, 1, 50, 255, 21, 1, 50, 255, 31, 1, 50, 255, 41, 1, 50, 255, 51, 1, 50, 255,
+			1, 21, 50, 255, 11, 21, 50, 255, 21, 21, 50, 255, 31, 21, 50, 255, 41, 21, 50, 255, 51, 21, 50, 255,
+			1, 41, 50, 255, 11, 41, 50, 255, 21, 41, 50, 255, 31, 41, 50, 255, 41, 41, 50, 255, 51, 41, 50, 255,
+			1, 61, 50, 255, 11, 61, 50, 255, 21, 61, 50, 255, 31, 61, 50, 255, 41, 61, 50, 255, 51, 61, 50, 255},
+		{2, 2, 100, 255, 12, 2, 100, 255, 22, 2, 100, 255, 32, 2, 100, 255, 42, 2, 100, 255, 52, 2, 100, 255,
+			2, 22, 100, 255, 12, 22, 100, 255, 22, 22, 100, 255, 32, 22, 100, 255, 42, 22, 100, 255, 52, 22, 100, 255,
+			2, 42, 100, 255, 12, 42, 100, 255, 22, 42, 100, 255, 32, 42, 100, 255, 42, 42, 100, 255, 52, 42, 100, 255,
+			2, 62, 100, 255, 12, 62, 100, 255, 22, 62, 100, 255, 32, 62, 100, 255, 42, 62, 100, 255, 52, 62, 100, 255},
+	}
+
+	f, err := os.Open("testdata/apng_basic.png")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	defer f.Close()
+
+	d, err := NewDecoder(f)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ac, ok := d.Animation()
+	if !ok {
+		t.Fatalf("expected an AnimationController")
+	}
+	if ac.NumFrames() != len(want) {
+		t.Fatalf("%d %d", ac.NumFrames(), len(want))
+	}
+
+	w, h := d.Bounds().Dx(), d.Bounds().Dy()
+	var got [][]byte
+	for {
+		ctl, fd, err := ac.NextFrame()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		if ctl.Width != w || ctl.Height != h {
+			t.Fatalf("%+v", ctl)
+		}
+
+		var pix []byte
+		if fd == nil {
+			// Frame 0: its pixels come from the main Decoder's own DecodeRow.
+			for y := 0; y < h; y++ {
+				row, err := d.DecodeRow()
+				if err != nil {
+					t.Fatalf("%+v", err)
+				}
+				pix = append(pix, row...)
+			}
+		} else {
+			for y := 0; y < h; y++ {
+				row, err := fd.DecodeRow()
+				if err != nil {
+					t.Fatalf("%+v", err)
+				}
+				pix = append(pix, row...)
+			}
+			if err := fd.Close(); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		got = append(got, pix)
+
+		if len(got) == len(want) {
+			break
+		}
+	}
+	if _, _, err := ac.NextFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %+v", err)
+	}
+
+	for i := range want {
+		if !bytes.Equal(want[i], got[i]) {
+			t.Fatalf("frame %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestAncillaryChunksRoundTrip(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	wantGamma := 0.45455
+	wantChroma := Chromaticities{WhiteX: 0.3127, WhiteY: 0.329, RedX: 0.64, RedY: 0.33, GreenX: 0.3, GreenY: 0.6, BlueX: 0.15, BlueY: 0.06}
+	wantPhys := PhysicalPixelDimensions{PixelsPerUnitX: 2835, PixelsPerUnitY: 2835, Unit: 1}
+	wantEXIF := []byte("II*\x00fake exif payload")
+	wantText := TextEntry{Keyword: "Comment", Text: "hello, ancillary chunks"}
+
+	var buf bytes.Buffer
+	re, err := NewRowEncoder(&buf, w, h,
+		WithGamma(wantGamma),
+		WithChromaticities(wantChroma),
+		WithPhysicalPixelDimensions(wantPhys),
+		WithEXIF(wantEXIF),
+		WithText(wantText),
+	)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var seen []string
+	d, err := NewDecoder(bytes.NewReader(buf.Bytes()), WithChunkHandler(chunkHandlerFunc(func(typ [4]byte, data []byte) error {
+		seen = append(seen, string(typ[:]))
+		return nil
+	})))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		if _, err := d.DecodeRow(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if gamma, ok := d.Gamma(); !ok || gamma != wantGamma {
+		t.Fatalf("%v %v", gamma, ok)
+	}
+	if chroma, ok := d.Chromaticities(); !ok || chroma != wantChroma {
+		t.Fatalf("%+v %v", chroma, ok)
+	}
+	if phys, ok := d.PhysicalPixelDimensions(); !ok || phys != wantPhys {
+		t.Fatalf("%+v %v", phys, ok)
+	}
+	if exif, ok := d.EXIF(); !ok || !bytes.Equal(exif, wantEXIF) {
+		t.Fatalf("%v %v", exif, ok)
+	}
+	text := d.Text()
+	if len(text) != 1 || text[0].Keyword != wantText.Keyword || text[0].Text != wantText.Text {
+		t.Fatalf("%+v", text)
+	}
+
+	wantTypes := []string{"cHRM", "gAMA", "pHYs", "eXIf", "tEXt"}
+	if len(seen) != len(wantTypes) {
+		t.Fatalf("%v", seen)
+	}
+	for i, typ := range wantTypes {
+		if seen[i] != typ {
+			t.Fatalf("%v", seen)
+		}
+	}
+}
+
+func TestChunkHandlerUnknownChunk(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	var plain bytes.Buffer
+	re, err := NewRowEncoder(&plain, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Splice an unrecognized ancillary chunk (tIME, which NewDecoder has no
+	// built-in parser for) in right after IHDR, to confirm a registered
+	// ChunkHandler still sees chunk types NewDecoder itself doesn't parse.
+	ihdrEnd := len(pngHeader) + 8 + 13 + 4
+	var spliced bytes.Buffer
+	spliced.Write(plain.Bytes()[:ihdrEnd])
+	wantTime := []byte{0x07, 0xe8, 1, 1, 0, 0, 0}
+	if err := writeChunk(&spliced, "tIME", wantTime); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	spliced.Write(plain.Bytes()[ihdrEnd:])
+
+	var seen [][]byte
+	d, err := NewDecoder(bytes.NewReader(spliced.Bytes()), WithChunkHandler(chunkHandlerFunc(func(typ [4]byte, data []byte) error {
+		if string(typ[:]) == "tIME" {
+			seen = append(seen, append([]byte(nil), data...))
+		}
+		return nil
+	})))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		if _, err := d.DecodeRow(); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	if len(seen) != 1 || !bytes.Equal(seen[0], wantTime) {
+		t.Fatalf("%v", seen)
+	}
+}
+
+// TestUnknownChunkHugeLengthNoHandler reproduces a memory-exhaustion DoS: a
+// chunk of a type nothing is registered to observe can declare an enormous
+// length without ever having to actually send that many bytes, since the
+// stream ends (or errors) long before it. NewDecoder must not allocate a
+// buffer sized to that declared length up front; it should stream-discard
+// instead and fail only once the bytes genuinely run out.
+func TestUnknownChunkHugeLengthNoHandler(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	var plain bytes.Buffer
+	re, err := NewRowEncoder(&plain, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Splice in an unrecognized chunk's header claiming a ~2GiB length,
+	// right after IHDR, with no actual data or CRC following it: an
+	// attacker need only send the 8-byte header, not the claimed payload.
+	ihdrEnd := len(pngHeader) + 8 + 13 + 4
+	var spliced bytes.Buffer
+	spliced.Write(plain.Bytes()[:ihdrEnd])
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], 0x7ffffffe)
+	copy(hdr[4:8], "zzzz")
+	spliced.Write(hdr[:])
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+
+	if _, err := NewDecoder(bytes.NewReader(spliced.Bytes())); err == nil {
+		t.Fatalf("expected an error for a chunk whose declared length exceeds what was actually sent")
+	}
+
+	runtime.ReadMemStats(&stats)
+	if grew := stats.TotalAlloc - before; grew > 1<<20 {
+		t.Fatalf("NewDecoder allocated %d bytes on a chunk declaring a ~2GiB length with no registered ChunkHandler", grew)
+	}
+}
+
+// TestUnknownChunkHugeLengthWithHandler is
+// TestUnknownChunkHugeLengthNoHandler's counterpart with a ChunkHandler
+// registered: that handler still needs to see the chunk's raw bytes, but
+// NewDecoder must grow its buffer as bytes actually arrive rather than
+// allocating the declared length upfront.
+func TestUnknownChunkHugeLengthWithHandler(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	var plain bytes.Buffer
+	re, err := NewRowEncoder(&plain, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ihdrEnd := len(pngHeader) + 8 + 13 + 4
+	var spliced bytes.Buffer
+	spliced.Write(plain.Bytes()[:ihdrEnd])
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], 0x7ffffffe)
+	copy(hdr[4:8], "zzzz")
+	spliced.Write(hdr[:])
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+
+	noop := chunkHandlerFunc(func(typ [4]byte, data []byte) error { return nil })
+	if _, err := NewDecoder(bytes.NewReader(spliced.Bytes()), WithChunkHandler(noop)); err == nil {
+		t.Fatalf("expected an error for a chunk whose declared length exceeds what was actually sent")
+	}
+
+	runtime.ReadMemStats(&stats)
+	if grew := stats.TotalAlloc - before; grew > 1<<20 {
+		t.Fatalf("NewDecoder allocated %d bytes on a chunk declaring a ~2GiB length with a registered ChunkHandler", grew)
+	}
+}
+
+// TestAncillaryFixedLengthRejectedBeforeAlloc covers a gAMA chunk (a
+// fixed-4-byte type) declaring a ~2GiB length: parseAncillary must reject it
+// via ancillaryFixedLength before ever allocating a buffer for its body.
+func TestAncillaryFixedLengthRejectedBeforeAlloc(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	var plain bytes.Buffer
+	re, err := NewRowEncoder(&plain, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ihdrEnd := len(pngHeader) + 8 + 13 + 4
+	var spliced bytes.Buffer
+	spliced.Write(plain.Bytes()[:ihdrEnd])
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], 0x7ffffffe)
+	copy(hdr[4:8], "gAMA")
+	spliced.Write(hdr[:])
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+
+	_, err = NewDecoder(bytes.NewReader(spliced.Bytes()))
+	if fe, ok := err.(FormatError); !ok || fe != "bad gAMA length" {
+		t.Fatalf("got %+v, want FormatError(\"bad gAMA length\")", err)
+	}
+
+	runtime.ReadMemStats(&stats)
+	if grew := stats.TotalAlloc - before; grew > 1<<20 {
+		t.Fatalf("NewDecoder allocated %d bytes on a gAMA chunk declaring a ~2GiB length", grew)
+	}
+}
+
+// TestVariableAncillaryLengthRejectedBeforeAlloc covers a tEXt chunk (a
+// variable-length type with no fixed size) declaring a ~2GiB length:
+// parseAncillary must reject it via maxVariableAncillaryLength before ever
+// allocating a buffer for its body, since tEXt is parsed unconditionally
+// regardless of whether any ChunkHandler is registered.
+func TestVariableAncillaryLengthRejectedBeforeAlloc(t *testing.T) {
+	fname := "testdata/basn6a08.png"
+	img, err := stdReadPNG(fname)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+
+	var plain bytes.Buffer
+	re, err := NewRowEncoder(&plain, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	ihdrEnd := len(pngHeader) + 8 + 13 + 4
+	var spliced bytes.Buffer
+	spliced.Write(plain.Bytes()[:ihdrEnd])
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:4], 0x7ffffffe)
+	copy(hdr[4:8], "tEXt")
+	spliced.Write(hdr[:])
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	before := stats.TotalAlloc
+
+	_, err = NewDecoder(bytes.NewReader(spliced.Bytes()))
+	if fe, ok := err.(FormatError); !ok || fe != "bad tEXt length" {
+		t.Fatalf("got %+v, want FormatError(\"bad tEXt length\")", err)
+	}
+
+	runtime.ReadMemStats(&stats)
+	if grew := stats.TotalAlloc - before; grew > 1<<20 {
+		t.Fatalf("NewDecoder allocated %d bytes on a tEXt chunk declaring a ~2GiB length", grew)
+	}
+}
+
+// TestAnimationDefaultImageNotFrame covers an APNG whose default image (the
+// one main-stream IDAT) is a plain fallback, not itself an animation frame,
+// i.e. no fcTL chunk precedes IDAT — a common pattern for viewers that
+// don't understand APNG. NextFrame must drain that IDAT data itself before
+// reading the real frame 0's fcTL/fdAT, since the caller has no reason to
+// call DecodeRow for a frame that was never exposed to them.
+func TestAnimationDefaultImageNotFrame(t *testing.T) {
+	// Random, so its compressed IDAT is large enough to span many zlib
+	// reads rather than fit entirely within read-ahead buffering that
+	// would otherwise mask NextFrame failing to drain it.
+	const defaultW, defaultH = 200, 200
+	defaultImg := image.NewNRGBA(image.Rect(0, 0, defaultW, defaultH))
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(defaultImg.Pix)
+
+	const frameW, frameH = 50, 50
+	frameImg := image.NewNRGBA(image.Rect(0, 0, frameW, frameH))
+	for y := 0; y < frameH; y++ {
+		for x := 0; x < frameW; x++ {
+			o := frameImg.PixOffset(x, y)
+			frameImg.Pix[o], frameImg.Pix[o+1], frameImg.Pix[o+2], frameImg.Pix[o+3] = uint8(x*3), uint8(y*5), 100, 255
+		}
+	}
+
+	defaultChunks := splitChunks(t, encodeNRGBA(t, defaultImg))
+	frameChunks := splitChunks(t, encodeNRGBA(t, frameImg))
+
+	var spliced bytes.Buffer
+	spliced.WriteString(pngHeader)
+	seq := uint32(0)
+	for _, c := range defaultChunks {
+		switch c.typ {
+		case "IHDR":
+			if err := writeChunk(&spliced, "IHDR", c.data); err != nil {
+				t.Fatalf("%+v", err)
+			}
+			// acTL must precede the first IDAT. Since no fcTL precedes it
+			// too, the default image below is not counted in numFrames.
+			var actl [8]byte
+			binary.BigEndian.PutUint32(actl[0:4], 1) // numFrames
+			binary.BigEndian.PutUint32(actl[4:8], 0) // numPlays: loop forever
+			if err := writeChunk(&spliced, "acTL", actl[:]); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		case "IDAT":
+			if err := writeChunk(&spliced, "IDAT", c.data); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		case "IEND":
+			// Deferred until after the real frame's fcTL/fdAT below.
+		default:
+			t.Fatalf("unexpected chunk in default image: %s", c.typ)
+		}
+	}
+
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:4], seq)
+	seq++
+	binary.BigEndian.PutUint32(fctl[4:8], uint32(frameW))
+	binary.BigEndian.PutUint32(fctl[8:12], uint32(frameH))
+	binary.BigEndian.PutUint16(fctl[20:22], 1)  // delayNum
+	binary.BigEndian.PutUint16(fctl[22:24], 10) // delayDen
+	fctl[24] = DisposeNone
+	fctl[25] = BlendSource
+	if err := writeChunk(&spliced, "fcTL", fctl); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for _, c := range frameChunks {
+		if c.typ != "IDAT" {
+			continue
+		}
+		body := make([]byte, 4+len(c.data))
+		binary.BigEndian.PutUint32(body[0:4], seq)
+		seq++
+		copy(body[4:], c.data)
+		if err := writeChunk(&spliced, "fdAT", body); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := writeChunk(&spliced, "IEND", nil); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	d, err := NewDecoder(bytes.NewReader(spliced.Bytes()))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ac, ok := d.Animation()
+	if !ok {
+		t.Fatalf("expected an AnimationController")
+	}
+	if ac.NumFrames() != 1 {
+		t.Fatalf("NumFrames() = %d, want 1", ac.NumFrames())
+	}
+
+	ctl, fd, err := ac.NextFrame()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if fd == nil {
+		t.Fatalf("expected a FrameDecoder, since the default image isn't frame 0")
+	}
+	if ctl.Width != frameW || ctl.Height != frameH {
+		t.Fatalf("%+v", ctl)
+	}
+	var got []byte
+	for y := 0; y < frameH; y++ {
+		row, err := fd.DecodeRow()
+		if err != nil {
+			t.Fatalf("%+v", err)
+		}
+		got = append(got, row...)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(got, frameImg.Pix) {
+		t.Fatalf("decoded frame pixels do not match")
+	}
+
+	if _, _, err := ac.NextFrame(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %+v", err)
+	}
+}
+
+// encodeNRGBA encodes img with NewRowEncoder's defaults and returns the
+// full PNG byte stream.
+func encodeNRGBA(t *testing.T, img *image.NRGBA) []byte {
+	t.Helper()
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	var buf bytes.Buffer
+	re, err := NewRowEncoder(&buf, w, h)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	for y := 0; y < h; y++ {
+		o := img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		if err := re.WriteRow(img.Pix[o : o+w*4]); err != nil {
+			t.Fatalf("%+v", err)
+		}
+	}
+	if err := re.Close(); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	return buf.Bytes()
+}
+
+// rawChunk is a verbatim PNG chunk's type and data, as found in an
+// already-encoded PNG byte stream.
+type rawChunk struct {
+	typ  string
+	data []byte
+}
+
+// splitChunks walks a full PNG byte stream (signature included) and returns
+// every chunk's type and data, in order, up to and including IEND.
+func splitChunks(t *testing.T, buf []byte) []rawChunk {
+	t.Helper()
+	buf = buf[len(pngHeader):]
+	var chunks []rawChunk
+	for {
+		length := binary.BigEndian.Uint32(buf[0:4])
+		typ := string(buf[4:8])
+		data := append([]byte(nil), buf[8:8+length]...)
+		chunks = append(chunks, rawChunk{typ, data})
+		buf = buf[8+length+4:]
+		if typ == "IEND" {
+			return chunks
+		}
+	}
+}
+
+// chunkHandlerFunc adapts a function to the ChunkHandler interface.
+type chunkHandlerFunc func(typ [4]byte, data []byte) error
+
+func (f chunkHandlerFunc) HandleChunk(typ [4]byte, data []byte) error { return f(typ, data) }
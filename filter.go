@@ -0,0 +1,80 @@
+package png
+
+// A filterFunc undoes one PNG filter type in place, reconstructing cdat (the
+// current row's bytes, post-filter on entry, pixel bytes on return) against
+// pdat (the already-reconstructed previous row, or an all-zero row for the
+// first scanline of an image or Adam7 pass). bytesPerPixel is the stride
+// between a byte and the byte to its left in the same channel, as per the
+// PNG spec's filter definitions.
+//
+// reconstructRow calls through the package-level subFilter/upFilter/
+// averageFilter/paethFilter vars rather than these functions directly, so
+// that init can swap in architecture-specific implementations.
+type filterFunc func(cdat, pdat []byte, bytesPerPixel int)
+
+// subFilter, upFilter, averageFilter and paethFilter are the filter
+// reconstructors reconstructRow dispatches through. They default to the
+// portable Go implementations below; init replaces them with vectorized
+// versions on architectures that have one, falling back to these generic
+// ones for any bytesPerPixel a vectorized version doesn't special-case.
+var (
+	subFilter     filterFunc = subGeneric
+	upFilter      filterFunc = upGeneric
+	averageFilter filterFunc = averageGeneric
+	paethFilter   filterFunc = paethGeneric
+)
+
+// subGeneric applies the Sub filter to cdat. pdat is unused; it is present
+// so subGeneric has the same signature as the other filterFuncs.
+func subGeneric(cdat, pdat []byte, bytesPerPixel int) {
+	for i := bytesPerPixel; i < len(cdat); i++ {
+		cdat[i] += cdat[i-bytesPerPixel]
+	}
+}
+
+// upGeneric applies the Up filter to cdat.
+func upGeneric(cdat, pdat []byte, bytesPerPixel int) {
+	for i, p := range pdat {
+		cdat[i] += p
+	}
+}
+
+// averageGeneric applies the Average filter to cdat.
+func averageGeneric(cdat, pdat []byte, bytesPerPixel int) {
+	// The first column has no column to the left of it, so it is a
+	// special case. We know that the first column exists because we
+	// check above that width != 0, and so len(cdat) != 0.
+	for i := 0; i < bytesPerPixel; i++ {
+		cdat[i] += pdat[i] / 2
+	}
+	for i := bytesPerPixel; i < len(cdat); i++ {
+		cdat[i] += uint8((int(cdat[i-bytesPerPixel]) + int(pdat[i])) / 2)
+	}
+}
+
+// paethGeneric applies the Paeth filter to cdat.
+func paethGeneric(cdat, pdat []byte, bytesPerPixel int) {
+	var a, b, c, pa, pb, pc int
+	for i := 0; i < bytesPerPixel; i++ {
+		a, c = 0, 0
+		for j := i; j < len(cdat); j += bytesPerPixel {
+			b = int(pdat[j])
+			pa = b - c
+			pb = a - c
+			pc = abs(pa + pb)
+			pa = abs(pa)
+			pb = abs(pb)
+			if pa <= pb && pa <= pc {
+				// No-op.
+			} else if pb <= pc {
+				a = b
+			} else {
+				a = c
+			}
+			a += int(cdat[j])
+			a &= 0xff
+			cdat[j] = uint8(a)
+			c = b
+		}
+	}
+}
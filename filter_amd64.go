@@ -0,0 +1,111 @@
+package png
+
+//go:noescape
+func cpuidEx(eaxIn, ecxIn uint32) (eax, ebx, ecx, edx uint32)
+
+//go:noescape
+func xgetbv() (eax, edx uint32)
+
+//go:noescape
+func upSSE2(cdat, pdat []byte)
+
+//go:noescape
+func upAVX2(cdat, pdat []byte)
+
+//go:noescape
+func subSSE2x4(cdat []byte)
+
+//go:noescape
+func averageSSE2x4(cdat, pdat []byte)
+
+//go:noescape
+func paethSSE2x4(cdat, pdat []byte)
+
+// hasAVX2 reports whether the CPU has AVX2, and the OS has enabled the
+// extended XMM/YMM register state AVX2 needs (CPUID.1:ECX.OSXSAVE and
+// XGETBV(0) aren't just CPUID.7:EBX.AVX2 on their own, since a CPU can
+// support AVX2 while an OS that predates it leaves it disabled).
+func hasAVX2() bool {
+	_, _, ecx1, _ := cpuidEx(1, 0)
+	const osxsaveBit = 1 << 27
+	const avxBit = 1 << 28
+	if ecx1&osxsaveBit == 0 || ecx1&avxBit == 0 {
+		return false
+	}
+	xcr0, _ := xgetbv()
+	const xmmAndYmmState = 1<<1 | 1<<2
+	if xcr0&xmmAndYmmState != xmmAndYmmState {
+		return false
+	}
+	_, ebx7, _, _ := cpuidEx(7, 0)
+	const avx2Bit = 1 << 5
+	return ebx7&avx2Bit != 0
+}
+
+func init() {
+	if hasAVX2() {
+		upFilter = upFilterAVX2
+	} else {
+		upFilter = upFilterSSE2
+	}
+	subFilter = subFilterSSE2
+	averageFilter = averageFilterSSE2
+	paethFilter = paethFilterSSE2
+}
+
+// upFilterSSE2 reconstructs the Up filter 16 bytes at a time; Up has no
+// cross-byte dependency for any bytesPerPixel, since each byte only ever
+// adds the byte directly above it, so it vectorizes without a bpp-specific
+// fast path.
+func upFilterSSE2(cdat, pdat []byte, bytesPerPixel int) {
+	n := len(cdat)
+	i := 0
+	for ; i+16 <= n; i += 16 {
+		upSSE2(cdat[i:i+16:i+16], pdat[i:i+16:i+16])
+	}
+	if i < n {
+		upGeneric(cdat[i:], pdat[i:], bytesPerPixel)
+	}
+}
+
+// upFilterAVX2 is upFilterSSE2's 32-byte-wide counterpart.
+func upFilterAVX2(cdat, pdat []byte, bytesPerPixel int) {
+	n := len(cdat)
+	i := 0
+	for ; i+32 <= n; i += 32 {
+		upAVX2(cdat[i:i+32:i+32], pdat[i:i+32:i+32])
+	}
+	if i < n {
+		upFilterSSE2(cdat[i:], pdat[i:], bytesPerPixel)
+	}
+}
+
+// subFilterSSE2 vectorizes the Sub filter across the four channels of one
+// bytesPerPixel==4 pixel per iteration; every other bytesPerPixel falls
+// back to subGeneric, since the per-channel stride would no longer line up
+// with a 4-byte lane.
+func subFilterSSE2(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 {
+		subGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	subSSE2x4(cdat)
+}
+
+// averageFilterSSE2 is averageGeneric's bytesPerPixel==4 fast path.
+func averageFilterSSE2(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 || len(pdat)%4 != 0 {
+		averageGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	averageSSE2x4(cdat, pdat)
+}
+
+// paethFilterSSE2 is paethGeneric's bytesPerPixel==4 fast path.
+func paethFilterSSE2(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 || len(pdat)%4 != 0 {
+		paethGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	paethSSE2x4(cdat, pdat)
+}
@@ -0,0 +1,34 @@
+package png
+
+// filterArchCases adds the amd64 SSE2-only implementations to
+// TestFilterDispatchMatchesGeneric's coverage, in addition to whichever
+// filterFunc vars init wired up for the host's actual CPU (which on any
+// AVX2-capable machine would otherwise never exercise the SSE2 fallback
+// paths at all).
+func filterArchCases() []struct {
+	name       string
+	dispatched filterFunc
+	generic    filterFunc
+} {
+	cases := []struct {
+		name       string
+		dispatched filterFunc
+		generic    filterFunc
+	}{
+		{"SubSSE2", subFilterSSE2, subGeneric},
+		{"UpSSE2", upFilterSSE2, upGeneric},
+		{"AverageSSE2", averageFilterSSE2, averageGeneric},
+		{"PaethSSE2", paethFilterSSE2, paethGeneric},
+	}
+	// upFilterAVX2 issues real AVX2 instructions, unlike the other cases
+	// above which only ever use SSE2; only exercise it directly when this
+	// host actually has AVX2, or it would SIGILL.
+	if hasAVX2() {
+		cases = append(cases, struct {
+			name       string
+			dispatched filterFunc
+			generic    filterFunc
+		}{"UpAVX2", upFilterAVX2, upGeneric})
+	}
+	return cases
+}
@@ -0,0 +1,67 @@
+package png
+
+//go:noescape
+func upNEON(cdat, pdat []byte)
+
+//go:noescape
+func subNEONx4(cdat []byte)
+
+//go:noescape
+func averageNEONx4(cdat, pdat []byte)
+
+//go:noescape
+func paethNEONx4(cdat, pdat []byte)
+
+// init installs the arm64 NEON fast paths for all four filter
+// reconstructors.
+func init() {
+	upFilter = upFilterNEON
+	subFilter = subFilterNEON
+	averageFilter = averageFilterNEON
+	paethFilter = paethFilterNEON
+}
+
+// upFilterNEON reconstructs the Up filter 16 bytes at a time; Up has no
+// cross-byte dependency for any bytesPerPixel, since each byte only ever
+// adds the byte directly above it, so it vectorizes without a bpp-specific
+// fast path.
+func upFilterNEON(cdat, pdat []byte, bytesPerPixel int) {
+	n := len(cdat)
+	i := 0
+	for ; i+16 <= n; i += 16 {
+		upNEON(cdat[i:i+16:i+16], pdat[i:i+16:i+16])
+	}
+	if i < n {
+		upGeneric(cdat[i:], pdat[i:], bytesPerPixel)
+	}
+}
+
+// subFilterNEON vectorizes the Sub filter across the four channels of one
+// bytesPerPixel==4 pixel per iteration; every other bytesPerPixel falls
+// back to subGeneric, since the per-channel stride would no longer line up
+// with a 4-byte lane.
+func subFilterNEON(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 {
+		subGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	subNEONx4(cdat)
+}
+
+// averageFilterNEON is averageGeneric's bytesPerPixel==4 fast path.
+func averageFilterNEON(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 || len(pdat)%4 != 0 {
+		averageGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	averageNEONx4(cdat, pdat)
+}
+
+// paethFilterNEON is paethGeneric's bytesPerPixel==4 fast path.
+func paethFilterNEON(cdat, pdat []byte, bytesPerPixel int) {
+	if bytesPerPixel != 4 || len(cdat)%4 != 0 || len(pdat)%4 != 0 {
+		paethGeneric(cdat, pdat, bytesPerPixel)
+		return
+	}
+	paethNEONx4(cdat, pdat)
+}
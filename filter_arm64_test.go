@@ -0,0 +1,20 @@
+package png
+
+// filterArchCases adds the arm64 NEON implementations of all four filter
+// reconstructors to TestFilterDispatchMatchesGeneric's coverage.
+func filterArchCases() []struct {
+	name       string
+	dispatched filterFunc
+	generic    filterFunc
+} {
+	return []struct {
+		name       string
+		dispatched filterFunc
+		generic    filterFunc
+	}{
+		{"UpNEON", upFilterNEON, upGeneric},
+		{"SubNEON", subFilterNEON, subGeneric},
+		{"AverageNEON", averageFilterNEON, averageGeneric},
+		{"PaethNEON", paethFilterNEON, paethGeneric},
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !amd64 && !arm64
+
+package png
+
+// filterArchCases has nothing to add on architectures with no
+// architecture-specific filter implementation at all; filterFunc vars stay
+// at their filter.go defaults, already covered by the base case list.
+func filterArchCases() []struct {
+	name       string
+	dispatched filterFunc
+	generic    filterFunc
+} {
+	return nil
+}
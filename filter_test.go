@@ -0,0 +1,56 @@
+package png
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestFilterDispatchMatchesGeneric differentially fuzzes the dispatched
+// subFilter/upFilter/averageFilter/paethFilter vars (potentially
+// architecture-specific SIMD implementations) against the portable
+// subGeneric/upGeneric/averageGeneric/paethGeneric they're meant to agree
+// with bit-for-bit, across a range of bytesPerPixel and row lengths.
+func TestFilterDispatchMatchesGeneric(t *testing.T) {
+	filters := []struct {
+		name       string
+		dispatched filterFunc
+		generic    filterFunc
+	}{
+		{"Sub", subFilter, subGeneric},
+		{"Up", upFilter, upGeneric},
+		{"Average", averageFilter, averageGeneric},
+		{"Paeth", paethFilter, paethGeneric},
+	}
+	filters = append(filters, filterArchCases()...)
+
+	r := rand.New(rand.NewSource(1))
+	for _, f := range filters {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			for _, bytesPerPixel := range []int{1, 2, 3, 4, 6, 8} {
+				for _, width := range []int{1, 2, 3, 4, 5, 8, 13, 37, 400} {
+					n := width * bytesPerPixel
+					if n == 0 {
+						continue
+					}
+					for trial := 0; trial < 20; trial++ {
+						cdat := make([]byte, n)
+						pdat := make([]byte, n)
+						r.Read(cdat)
+						r.Read(pdat)
+
+						gotCdat := append([]byte(nil), cdat...)
+						wantCdat := append([]byte(nil), cdat...)
+
+						f.dispatched(gotCdat, pdat, bytesPerPixel)
+						f.generic(wantCdat, pdat, bytesPerPixel)
+
+						if string(gotCdat) != string(wantCdat) {
+							t.Fatalf("bytesPerPixel=%d width=%d trial=%d: dispatched %v, generic %v", bytesPerPixel, width, trial, gotCdat, wantCdat)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package png
+
+// intSize is either 32 or 64.
+const intSize = 32 << (^uint(0) >> 63)
+
+func abs(x int) int {
+	// m := -1 if x < 0. m := 0 otherwise.
+	m := x >> (intSize - 1)
+
+	// In two's complement representation, the negative number
+	// of any number (except the smallest one) can be computed
+	// by flipping all the bits and add 1. This is faster than
+	// code with a branch.
+	// See Hacker's Delight, section 2-4.
+	return (x ^ m) - m
+}
+
+// paethPredictor returns the Paeth predictor for a pixel given its left (a),
+// above (b), and upper-left (c) neighbor byte values, as per the PNG spec.
+// It is the encoding counterpart to the per-byte logic in paethGeneric.
+func paethPredictor(a, b, c uint8) uint8 {
+	pa := abs(int(b) - int(c))
+	pb := abs(int(a) - int(c))
+	pc := abs(int(a) + int(b) - 2*int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
@@ -4,6 +4,7 @@
 package png
 
 import (
+	"bytes"
 	"compress/zlib"
 	"encoding/binary"
 	"fmt"
@@ -16,15 +17,41 @@ import (
 
 // Color type, as per the PNG spec.
 const (
+	ctGrayscale      = 0
+	ctTrueColor      = 2
+	ctPaletted       = 3
+	ctGrayscaleAlpha = 4
 	ctTrueColorAlpha = 6
 )
 
 // A cb is a combination of color type and bit depth.
 const (
 	cbInvalid = iota
+	cbG1
+	cbG2
+	cbG4
+	cbG8
+	cbGA8
+	cbTC8
+	cbP1
+	cbP2
+	cbP4
+	cbP8
 	cbTCA8
+	cbG16
+	cbGA16
+	cbTC16
+	cbTCA16
 )
 
+func cbPaletted(cb int) bool {
+	return cbP1 <= cb && cb <= cbP8
+}
+
+func cbTrueColor(cb int) bool {
+	return cb == cbTC8 || cb == cbTC16
+}
+
 // Filter type, as per the PNG spec.
 const (
 	ftNone    = 0
@@ -44,29 +71,90 @@ const (
 const (
 	dsStart = iota
 	dsSeenIHDR
+	dsSeenPLTE
+	dsSeentRNS
 	dsSeenIDAT
 	dsSeenIEND
 )
 
 const pngHeader = "\x89PNG\r\n\x1a\n"
 
-// A Decoder is a row-by-row decoder for png image.NRGBA images.
+// A DecoderOption configures optional behavior of NewDecoder.
+type DecoderOption func(*decoderOptions)
+
+type decoderOptions struct {
+	rejectInterlaced bool
+	chunkHandlers    []ChunkHandler
+}
+
+// RejectInterlace makes NewDecoder return an UnsupportedError for an
+// Adam7-interlaced image instead of decoding it, for callers that only want
+// the faster, O(1)-memory single-pass path and would rather fail fast than
+// pay for deinterlacing (see Decoder's doc comment for the interlaced
+// memory cost this avoids).
+func RejectInterlace() DecoderOption {
+	return func(o *decoderOptions) { o.rejectInterlaced = true }
+}
+
+// A Decoder is a row-by-row decoder for png images.
 // Compared to the standard library, it reduces memory usage by loading only the current row.
+// Regardless of the source color type and bit depth, DecodeRow always returns
+// one row of NRGBA bytes, converting on the fly; ColorModel reports the
+// source format for callers that care.
+//
+// For an Adam7-interlaced image this guarantee is weaker: Adam7 interleaves
+// every row into the same 7-pass stream, so DecodeRow can't return output
+// row 0 until pass 6 has gone by, and by then passes 1-5 have already
+// deposited partial data for roughly half the image's rows. Peak memory is
+// therefore O(height), at about half of what buffering the whole decoded
+// image would cost, not O(1) or O(sqrt(height)). Callers that need the
+// tighter bound should use RejectInterlace and require non-interlaced
+// input instead.
 type Decoder struct {
 	d *decoder
 
 	zlibR         io.ReadCloser
+	bitsPerPixel  int
 	bytesPerPixel int
 	cr            []uint8
 	pr            []uint8
+	row           []uint8
 	y             int
+
+	// pass and passY track progress through the Adam7 passes for an
+	// interlaced image; unused otherwise.
+	pass  int
+	passY int
+	// rowCache holds the NRGBA bytes accumulated so far for an output row
+	// still being contributed to by later passes, indexed by that row.
+	// rowDone marks a row as having received its last contribution, i.e.
+	// ready for DecodeRow to return. Entries are freed as soon as they are
+	// returned, but this is still O(height) memory with roughly a 0.5
+	// constant at peak, not sub-linear in it: passes 1-5 fill in most even
+	// rows before pass 6 (the pass that completes them) even starts, so
+	// close to half of rowCache's entries are typically live by the time
+	// the first row is ready to return.
+	rowCache [][]uint8
+	rowDone  []bool
+
+	// idatClosed tracks whether the IDAT zlib stream has already been
+	// closed and its checksum verified, so both Close and
+	// AnimationController.NextFrame can call closeIDAT without either one
+	// caring whether the other got there first.
+	idatClosed bool
 }
 
 // NewDecoder decodes the metadata of an image data stream.
-func NewDecoder(r io.Reader) (*Decoder, error) {
+func NewDecoder(r io.Reader, opts ...DecoderOption) (*Decoder, error) {
+	var o decoderOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	d := &decoder{
-		r:   r,
-		crc: crc32.NewIEEE(),
+		r:             r,
+		crc:           crc32.NewIEEE(),
+		chunkHandlers: o.chunkHandlers,
 	}
 	if err := d.checkHeader(); err != nil {
 		if err == io.EOF {
@@ -97,28 +185,79 @@ func NewDecoder(r io.Reader) (*Decoder, error) {
 				}
 				return nil, err
 			}
-			if d.cb != cbTCA8 {
-				return nil, fmt.Errorf("color type and bit depth not cbTCA8 %v", d.cb)
+			if o.rejectInterlaced && d.interlace != 0 {
+				return nil, UnsupportedError("interlaced image")
+			}
+		case "PLTE":
+			if d.stage != dsSeenIHDR {
+				return nil, chunkOrderError
+			}
+			d.stage = dsSeenPLTE
+			if err := d.parsePLTE(length); err != nil {
+				return nil, err
+			}
+		case "tRNS":
+			if cbPaletted(d.cb) {
+				if d.stage != dsSeenPLTE {
+					return nil, chunkOrderError
+				}
+			} else if cbTrueColor(d.cb) {
+				if d.stage != dsSeenIHDR && d.stage != dsSeenPLTE {
+					return nil, chunkOrderError
+				}
+			} else if d.stage != dsSeenIHDR {
+				return nil, chunkOrderError
+			}
+			d.stage = dsSeentRNS
+			if err := d.parsetRNS(length); err != nil {
+				return nil, err
 			}
 		case "IDAT":
-			if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT {
+			if d.stage < dsSeenIHDR || d.stage > dsSeenIDAT || (d.stage == dsSeenIHDR && cbPaletted(d.cb)) {
 				return nil, chunkOrderError
 			}
 			d.idatLength = length
 			d.stage = dsSeenIDAT
+		case "acTL":
+			if d.stage != dsSeenIHDR {
+				return nil, chunkOrderError
+			}
+			if err := d.parseAncillary(header, length); err != nil {
+				return nil, err
+			}
+		case "fcTL":
+			if err := d.parseAncillary(header, length); err != nil {
+				return nil, err
+			}
+		case "gAMA", "cHRM", "iCCP", "pHYs", "tEXt", "zTXt", "iTXt", "eXIf":
+			if err := d.parseAncillary(header, length); err != nil {
+				return nil, err
+			}
 		default:
 			if length > 0x7fffffff {
 				return nil, FormatError(fmt.Sprintf("Bad chunk length: %d", length))
 			}
-			// Ignore this chunk (of a known length).
-			var ignored [4096]byte
-			for length > 0 {
-				n, err := io.ReadFull(d.r, ignored[:min(len(ignored), int(length))])
-				if err != nil {
+			if len(d.chunkHandlers) == 0 {
+				// Nothing is registered to look at this chunk type's bytes,
+				// so stream them to nowhere instead of buffering a length
+				// that is entirely attacker-controlled.
+				if err := d.discardChunk(length); err != nil {
 					return nil, err
 				}
-				d.crc.Write(ignored[:n])
-				length -= uint32(n)
+				break
+			}
+			// A registered ChunkHandler still gets to see this chunk's raw
+			// bytes, so read it into a buffer rather than just discarding it
+			// unread. readChunkData grows that buffer as bytes actually
+			// arrive instead of allocating length upfront, for the same
+			// reason discardChunk above doesn't just make([]byte, length).
+			data, err := d.readChunkData(length)
+			if err != nil {
+				return nil, err
+			}
+			d.crc.Write(data)
+			if err := d.runChunkHandlers(header, data); err != nil {
+				return nil, err
 			}
 			if err := d.verifyChecksum(); err != nil {
 				return nil, err
@@ -134,17 +273,39 @@ func NewDecoder(r io.Reader) (*Decoder, error) {
 		return nil, err
 	}
 
-	bitsPerPixel := 32
-	dec.bytesPerPixel = (bitsPerPixel + 7) / 8
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8, cbP1, cbP2, cbP4, cbP8:
+		dec.bitsPerPixel = d.depth
+	case cbGA8, cbG16:
+		dec.bitsPerPixel = 16
+	case cbTC8:
+		dec.bitsPerPixel = 24
+	case cbTCA8, cbGA16:
+		dec.bitsPerPixel = 32
+	case cbTC16:
+		dec.bitsPerPixel = 48
+	case cbTCA16:
+		dec.bitsPerPixel = 64
+	}
+	dec.bytesPerPixel = (dec.bitsPerPixel + 7) / 8
 
-	// The +1 is for the per-row filter type, which is at cr[0].
-	rowSize := 1 + (int64(bitsPerPixel)*int64(d.width)+7)/8
-	if rowSize != int64(int(rowSize)) {
-		return nil, UnsupportedError("dimension overflow")
+	if d.interlace == 0 {
+		// The +1 is for the per-row filter type, which is at cr[0].
+		rowSize := 1 + (int64(dec.bitsPerPixel)*int64(d.width)+7)/8
+		if rowSize != int64(int(rowSize)) {
+			return nil, UnsupportedError("dimension overflow")
+		}
+		// cr and pr are the bytes for the current and previous row.
+		dec.cr = make([]uint8, rowSize)
+		dec.pr = make([]uint8, rowSize)
+		// row holds the NRGBA bytes that DecodeRow returns, converted from
+		// whatever color type and bit depth the source image uses.
+		dec.row = make([]uint8, d.width*4)
+	} else {
+		dec.pass = 1
+		dec.rowCache = make([][]uint8, d.height)
+		dec.rowDone = make([]bool, d.height)
 	}
-	// cr and pr are the bytes for the current and previous row.
-	dec.cr = make([]uint8, rowSize)
-	dec.pr = make([]uint8, rowSize)
 
 	return dec, nil
 }
@@ -154,76 +315,378 @@ func (d *Decoder) Bounds() image.Rectangle {
 	return image.Rect(0, 0, d.d.width, d.d.height)
 }
 
-// DecodeRow decodes the current row.
+// ColorModel returns the color model of the source PNG, which describes the
+// image as it is encoded on disk. DecodeRow always converts to NRGBA
+// regardless of this model.
+func (d *Decoder) ColorModel() color.Model {
+	switch d.d.cb {
+	case cbG1, cbG2, cbG4, cbG8:
+		return color.GrayModel
+	case cbGA8:
+		return color.NRGBAModel
+	case cbTC8:
+		return color.RGBAModel
+	case cbP1, cbP2, cbP4, cbP8:
+		return d.d.palette
+	case cbTCA8:
+		return color.NRGBAModel
+	case cbG16:
+		return color.Gray16Model
+	case cbGA16:
+		return color.NRGBA64Model
+	case cbTC16:
+		return color.RGBA64Model
+	case cbTCA16:
+		return color.NRGBA64Model
+	}
+	return nil
+}
+
+// DecodeRow decodes the current row and returns it as NRGBA bytes,
+// converting on the fly from the source color type and bit depth.
 // Users must take care of not modifying the returned buffer,
 // as it is used in the decoding of subsequent rows.
 func (d *Decoder) DecodeRow() ([]byte, error) {
 	if d.y >= d.d.height {
 		return nil, io.EOF
 	}
+	if d.d.interlace != 0 {
+		return d.decodeInterlacedRow()
+	}
 
-	// Read the decompressed bytes.
-	_, err := io.ReadFull(d.zlibR, d.cr)
+	cdat, err := reconstructRow(d.zlibR, d.cr, d.pr, d.bytesPerPixel)
 	if err != nil {
+		return nil, err
+	}
+
+	d.d.convertRow(cdat, d.d.width, func(x int, r, g, b, a uint8) {
+		o := 4 * x
+		d.row[o], d.row[o+1], d.row[o+2], d.row[o+3] = r, g, b, a
+	})
+
+	d.pr, d.cr = d.cr, d.pr
+	d.y++
+	return d.row, nil
+}
+
+// reconstructRow reads one filtered scanline from r into cr and undoes its
+// filter in place against the previous scanline pdat, returning the
+// reconstructed pixel bytes (i.e. cr without its leading filter-type byte).
+// It is shared by Decoder's non-interlaced and Adam7 paths, and by
+// FrameDecoder, all of which read from a zlib stream over a different
+// underlying chunk type.
+func reconstructRow(r io.Reader, cr, pr []uint8, bytesPerPixel int) ([]byte, error) {
+	if _, err := io.ReadFull(r, cr); err != nil {
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			return nil, FormatError("not enough pixel data")
 		}
 		return nil, err
 	}
 
-	// Apply the filter.
-	cdat := d.cr[1:]
-	pdat := d.pr[1:]
-	switch d.cr[0] {
+	cdat := cr[1:]
+	pdat := pr[1:]
+	switch cr[0] {
 	case ftNone:
 		// No-op.
 	case ftSub:
-		for i := d.bytesPerPixel; i < len(cdat); i++ {
-			cdat[i] += cdat[i-d.bytesPerPixel]
-		}
+		subFilter(cdat, pdat, bytesPerPixel)
 	case ftUp:
-		for i, p := range pdat {
-			cdat[i] += p
-		}
+		upFilter(cdat, pdat, bytesPerPixel)
 	case ftAverage:
-		// The first column has no column to the left of it, so it is a
-		// special case. We know that the first column exists because we
-		// check above that width != 0, and so len(cdat) != 0.
-		for i := 0; i < d.bytesPerPixel; i++ {
-			cdat[i] += pdat[i] / 2
-		}
-		for i := d.bytesPerPixel; i < len(cdat); i++ {
-			cdat[i] += uint8((int(cdat[i-d.bytesPerPixel]) + int(pdat[i])) / 2)
-		}
+		averageFilter(cdat, pdat, bytesPerPixel)
 	case ftPaeth:
-		filterPaeth(cdat, pdat, d.bytesPerPixel)
+		paethFilter(cdat, pdat, bytesPerPixel)
 	default:
 		return nil, FormatError("bad filter type")
 	}
+	return cdat, nil
+}
 
-	d.pr, d.cr = d.cr, d.pr
+// adam7Pass describes the starting pixel and stride of one of the seven
+// Adam7 interlacing passes, as per the PNG spec
+// (https://www.w3.org/TR/PNG/#8Interlace).
+type adam7Pass struct {
+	startX, startY, dx, dy int
+}
+
+var adam7Passes = [7]adam7Pass{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// dim returns the width and height of this pass's sub-image of a width by
+// height image, which are 0 if the pass contributes no pixels at all.
+func (p adam7Pass) dim(width, height int) (w, h int) {
+	w = (width - p.startX + p.dx - 1) / p.dx
+	h = (height - p.startY + p.dy - 1) / p.dy
+	if w < 0 {
+		w = 0
+	}
+	if h < 0 {
+		h = 0
+	}
+	return w, h
+}
+
+// decodeInterlacedRow returns output row d.y, decoding Adam7 passes from the
+// zlib stream until that row is complete. Passes are stored in the stream in
+// order 1 through 7, and every row is fully contributed to by the time the
+// last pass that actually touches it (see isLastTouch) reaches it, so rows
+// are always ready in output order and rowCache never has to hold a row
+// DecodeRow has already returned. That bounds rowCache's entries to the rows
+// not yet returned, but does not make it sub-linear in image height: see
+// rowCache's field comment on Decoder for the actual peak-memory behavior.
+func (d *Decoder) decodeInterlacedRow() ([]byte, error) {
+	for !d.rowDone[d.y] {
+		if err := d.decodeNextPassRow(); err != nil {
+			return nil, err
+		}
+	}
+	row := d.rowCache[d.y]
+	d.rowCache[d.y] = nil
 	d.y++
-	return cdat, nil
+	return row, nil
+}
+
+// decodeNextPassRow reconstructs the next scanline of the current Adam7
+// pass, depositing its pixels into the rowCache entries they belong to, and
+// advances to the next pass once the current one is exhausted.
+func (d *Decoder) decodeNextPassRow() error {
+	var p adam7Pass
+	var pw int
+	for {
+		if d.pass > len(adam7Passes) {
+			return FormatError("not enough pixel data")
+		}
+		p = adam7Passes[d.pass-1]
+		var ph int
+		pw, ph = p.dim(d.d.width, d.d.height)
+		if pw > 0 && ph > 0 && d.passY < ph {
+			break
+		}
+		d.pass++
+		d.passY = 0
+	}
+
+	if d.passY == 0 {
+		rowSize := 1 + (int64(d.bitsPerPixel)*int64(pw)+7)/8
+		if rowSize != int64(int(rowSize)) {
+			return UnsupportedError("dimension overflow")
+		}
+		d.cr = make([]uint8, rowSize)
+		d.pr = make([]uint8, rowSize)
+	}
+
+	cdat, err := reconstructRow(d.zlibR, d.cr, d.pr, d.bytesPerPixel)
+	if err != nil {
+		return err
+	}
+
+	destY := p.startY + d.passY*p.dy
+	cache := d.rowCache[destY]
+	if cache == nil {
+		cache = make([]uint8, d.d.width*4)
+		d.rowCache[destY] = cache
+	}
+	d.d.convertRow(cdat, pw, func(x int, r, g, b, a uint8) {
+		o := 4 * (p.startX + x*p.dx)
+		cache[o], cache[o+1], cache[o+2], cache[o+3] = r, g, b, a
+	})
+	if isLastTouch(d.pass, destY, d.d.width, d.d.height) {
+		d.rowDone[destY] = true
+	}
+
+	d.pr, d.cr = d.cr, d.pr
+	d.passY++
+	return nil
+}
+
+// isLastTouch reports whether pass (1-based, as stored in Decoder.pass) is
+// the last of the 7 Adam7 passes to contribute a pixel to output row y, for
+// an image of the given width and height. For images at least 2px wide,
+// that's always pass 6 for even rows and pass 7 for odd rows, since passes
+// 1-5 only ever fill in columns pass 6 and 7 also cover. But dim's w is 0
+// for a pass that starts past the last column (e.g. pass 6, at x=1, for a
+// 1px-wide image), and such a pass is skipped entirely by
+// decodeNextPassRow, so the real completing pass can be earlier.
+func isLastTouch(pass, y, width, height int) bool {
+	for i := pass + 1; i <= len(adam7Passes); i++ {
+		p := adam7Passes[i-1]
+		pw, ph := p.dim(width, height)
+		if pw == 0 || ph == 0 {
+			continue
+		}
+		dy := y - p.startY
+		if dy >= 0 && dy%p.dy == 0 && dy/p.dy < ph {
+			return false
+		}
+	}
+	return true
+}
+
+// unpackBits calls fn once per pixel packed depth bits-per-pixel into row,
+// for the sub-byte bit depths 1, 2 and 4.
+func unpackBits(row []byte, width, depth int, fn func(x int, idx uint8)) {
+	shift := uint(8 - depth)
+	mask := uint8(1<<depth - 1)
+	perByte := 8 / depth
+	for x := 0; x < width; x += perByte {
+		b := row[x/perByte]
+		for x2 := 0; x2 < perByte && x+x2 < width; x2++ {
+			fn(x+x2, (b>>shift)&mask)
+			b <<= uint(depth)
+		}
+	}
+}
+
+// paletteNRGBA resolves a palette index into NRGBA bytes, growing the
+// palette's visible length (up to its backing capacity of 256) the same way
+// the standard library tolerates out-of-range indices in malformed PNGs.
+func paletteNRGBA(p *color.Palette, idx uint8) (r, g, b, a uint8) {
+	if len(*p) <= int(idx) {
+		*p = (*p)[:int(idx)+1]
+	}
+	c := color.NRGBAModel.Convert((*p)[idx]).(color.NRGBA)
+	return c.R, c.G, c.B, c.A
+}
+
+// convertRow converts cdat, the reconstructed bytes for a row of width
+// pixels in the source color type and bit depth, into NRGBA, calling put
+// once per pixel with its x coordinate within that row. Non-interlaced
+// images call put with the output row's own coordinates; Adam7 passes call
+// it with coordinates local to the pass and remap them to the output image.
+func (dd *decoder) convertRow(cdat []byte, width int, put func(x int, r, g, b, a uint8)) {
+	switch dd.cb {
+	case cbG1, cbG2, cbG4:
+		var scale uint8
+		switch dd.cb {
+		case cbG1:
+			scale = 0xff
+		case cbG2:
+			scale = 0x55
+		case cbG4:
+			scale = 0x11
+		}
+		ty := dd.transparent[1]
+		unpackBits(cdat, width, dd.depth, func(x int, idx uint8) {
+			ycol := idx * scale
+			acol := uint8(0xff)
+			if dd.useTransparent && ycol == ty {
+				acol = 0x00
+			}
+			put(x, ycol, ycol, ycol, acol)
+		})
+	case cbG8:
+		ty := dd.transparent[1]
+		for x := 0; x < width; x++ {
+			ycol := cdat[x]
+			acol := uint8(0xff)
+			if dd.useTransparent && ycol == ty {
+				acol = 0x00
+			}
+			put(x, ycol, ycol, ycol, acol)
+		}
+	case cbGA8:
+		for x := 0; x < width; x++ {
+			ycol := cdat[2*x+0]
+			put(x, ycol, ycol, ycol, cdat[2*x+1])
+		}
+	case cbTC8:
+		tr, tg, tb := dd.transparent[1], dd.transparent[3], dd.transparent[5]
+		for x := 0; x < width; x++ {
+			r, g, b := cdat[3*x+0], cdat[3*x+1], cdat[3*x+2]
+			a := uint8(0xff)
+			if dd.useTransparent && r == tr && g == tg && b == tb {
+				a = 0x00
+			}
+			put(x, r, g, b, a)
+		}
+	case cbP1, cbP2, cbP4:
+		unpackBits(cdat, width, dd.depth, func(x int, idx uint8) {
+			r, g, b, a := paletteNRGBA(&dd.palette, idx)
+			put(x, r, g, b, a)
+		})
+	case cbP8:
+		for x := 0; x < width; x++ {
+			r, g, b, a := paletteNRGBA(&dd.palette, cdat[x])
+			put(x, r, g, b, a)
+		}
+	case cbTCA8:
+		for x := 0; x < width; x++ {
+			put(x, cdat[4*x+0], cdat[4*x+1], cdat[4*x+2], cdat[4*x+3])
+		}
+	case cbG16:
+		ty := uint16(dd.transparent[0])<<8 | uint16(dd.transparent[1])
+		for x := 0; x < width; x++ {
+			ycol16 := uint16(cdat[2*x+0])<<8 | uint16(cdat[2*x+1])
+			ycol := uint8(ycol16 >> 8)
+			acol := uint8(0xff)
+			if dd.useTransparent && ycol16 == ty {
+				acol = 0x00
+			}
+			put(x, ycol, ycol, ycol, acol)
+		}
+	case cbGA16:
+		for x := 0; x < width; x++ {
+			ycol := cdat[4*x+0]
+			put(x, ycol, ycol, ycol, cdat[4*x+2])
+		}
+	case cbTC16:
+		tr := uint16(dd.transparent[0])<<8 | uint16(dd.transparent[1])
+		tg := uint16(dd.transparent[2])<<8 | uint16(dd.transparent[3])
+		tb := uint16(dd.transparent[4])<<8 | uint16(dd.transparent[5])
+		for x := 0; x < width; x++ {
+			r16 := uint16(cdat[6*x+0])<<8 | uint16(cdat[6*x+1])
+			g16 := uint16(cdat[6*x+2])<<8 | uint16(cdat[6*x+3])
+			b16 := uint16(cdat[6*x+4])<<8 | uint16(cdat[6*x+5])
+			a := uint8(0xff)
+			if dd.useTransparent && r16 == tr && g16 == tg && b16 == tb {
+				a = 0x00
+			}
+			put(x, uint8(r16>>8), uint8(g16>>8), uint8(b16>>8), a)
+		}
+	case cbTCA16:
+		for x := 0; x < width; x++ {
+			put(x, cdat[8*x+0], cdat[8*x+2], cdat[8*x+4], cdat[8*x+6])
+		}
+	}
 }
 
 // Close checks the validity of the decoded image stream at the end.
+//
+// Close must not be called on a Decoder whose Animation controller is in
+// use; AnimationController.NextFrame consumes the trailing chunks itself as
+// the animation is iterated, including the final IEND.
 func (d *Decoder) Close() error {
 	if d.d.stage == dsSeenIEND {
 		return nil
 	}
-
-	if err := d.zlibR.Close(); err != nil {
+	if err := d.closeIDAT(); err != nil {
 		return err
 	}
-	if err := d.d.verifyChecksum(); err != nil {
+	if err := d.d.readIEND(); err != nil {
 		return err
 	}
+	d.d.stage = dsSeenIEND
+	return nil
+}
 
-	if err := d.d.readIEND(); err != nil {
+// closeIDAT closes the IDAT zlib stream and verifies its final chunk's
+// checksum, if that has not already happened.
+func (d *Decoder) closeIDAT() error {
+	if d.idatClosed {
+		return nil
+	}
+	d.idatClosed = true
+	if err := d.zlibR.Close(); err != nil {
 		return err
 	}
-
-	return nil
+	return d.d.verifyChecksum()
 }
 
 type decoder struct {
@@ -243,6 +706,12 @@ type decoder struct {
 	// transparency, as opposed to palette transparency.
 	useTransparent bool
 	transparent    [6]byte
+
+	// meta holds the typed ancillary chunk data built up by the handlers in
+	// chunks.go as NewDecoder scans past IHDR.
+	meta meta
+
+	chunkHandlers []ChunkHandler
 }
 
 // A FormatError reports that the input is not a valid PNG.
@@ -297,22 +766,196 @@ func (d *decoder) parseIHDR(length uint32) error {
 	d.cb = cbInvalid
 	d.depth = int(d.tmp[8])
 	switch d.depth {
+	case 1:
+		switch d.tmp[9] {
+		case ctGrayscale:
+			d.cb = cbG1
+		case ctPaletted:
+			d.cb = cbP1
+		}
+	case 2:
+		switch d.tmp[9] {
+		case ctGrayscale:
+			d.cb = cbG2
+		case ctPaletted:
+			d.cb = cbP2
+		}
+	case 4:
+		switch d.tmp[9] {
+		case ctGrayscale:
+			d.cb = cbG4
+		case ctPaletted:
+			d.cb = cbP4
+		}
 	case 8:
 		switch d.tmp[9] {
+		case ctGrayscale:
+			d.cb = cbG8
+		case ctTrueColor:
+			d.cb = cbTC8
+		case ctPaletted:
+			d.cb = cbP8
+		case ctGrayscaleAlpha:
+			d.cb = cbGA8
 		case ctTrueColorAlpha:
 			d.cb = cbTCA8
 		}
+	case 16:
+		switch d.tmp[9] {
+		case ctGrayscale:
+			d.cb = cbG16
+		case ctTrueColor:
+			d.cb = cbTC16
+		case ctGrayscaleAlpha:
+			d.cb = cbGA16
+		case ctTrueColorAlpha:
+			d.cb = cbTCA16
+		}
 	}
 	if d.cb == cbInvalid {
 		return UnsupportedError(fmt.Sprintf("bit depth %d, color type %d", d.tmp[8], d.tmp[9]))
 	}
+	if d.tmp[12] != 0 && d.tmp[12] != 1 {
+		return FormatError(fmt.Sprintf("invalid interlace method %d", d.tmp[12]))
+	}
+	d.interlace = int(d.tmp[12])
 	d.width, d.height = int(w), int(h)
 	return d.verifyChecksum()
 }
 
+func (d *decoder) parsePLTE(length uint32) error {
+	np := int(length / 3) // The number of palette entries.
+	if length%3 != 0 || np <= 0 || np > 256 || np > 1<<uint(d.depth) {
+		return FormatError("bad PLTE length")
+	}
+	n, err := io.ReadFull(d.r, d.tmp[:3*np])
+	if err != nil {
+		return err
+	}
+	d.crc.Write(d.tmp[:n])
+	switch d.cb {
+	case cbP1, cbP2, cbP4, cbP8:
+		d.palette = make(color.Palette, 256)
+		for i := 0; i < np; i++ {
+			d.palette[i] = color.RGBA{d.tmp[3*i+0], d.tmp[3*i+1], d.tmp[3*i+2], 0xff}
+		}
+		for i := np; i < 256; i++ {
+			// Initialize the rest of the palette to opaque black. The spec (section
+			// 11.2.3) says that "any out-of-range pixel value found in the image data
+			// is an error", but some real-world PNG files have out-of-range pixel
+			// values. We fall back to opaque black, the same as libpng 1.5.13;
+			// ImageMagick 6.5.7 returns an error.
+			d.palette[i] = color.RGBA{0x00, 0x00, 0x00, 0xff}
+		}
+		d.palette = d.palette[:np]
+	case cbTC8, cbTCA8, cbTC16, cbTCA16:
+		// As per the PNG spec, a PLTE chunk is optional (and for practical purposes,
+		// ignorable) for the ctTrueColor and ctTrueColorAlpha color types (section 4.1.2).
+	default:
+		return FormatError("PLTE, color type mismatch")
+	}
+	return d.verifyChecksum()
+}
+
+// discardChunk reads and discards length bytes of the current chunk through
+// a fixed-size buffer, so that a chunk type nothing is registered to observe
+// can't force a single allocation sized to an attacker-controlled length.
+func (d *decoder) discardChunk(length uint32) error {
+	var ignored [4096]byte
+	for length > 0 {
+		n, err := io.ReadFull(d.r, ignored[:min(len(ignored), int(length))])
+		if err != nil {
+			return err
+		}
+		d.crc.Write(ignored[:n])
+		length -= uint32(n)
+	}
+	return d.verifyChecksum()
+}
+
+// readChunkData reads length bytes of the current chunk for a registered
+// ChunkHandler to inspect. It grows its buffer as bytes actually arrive
+// off d.r, rather than allocating length upfront like make([]byte, length)
+// would, so an attacker-controlled length can't force a multi-gigabyte
+// allocation before the stream is confirmed to actually contain that many
+// bytes. Unlike discardChunk, it does not verify the chunk's checksum: the
+// caller still needs to feed data to the handlers and the CRC first.
+func (d *decoder) readChunkData(length uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, d.r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *decoder) parsetRNS(length uint32) error {
+	switch d.cb {
+	case cbG1, cbG2, cbG4, cbG8, cbG16:
+		if length != 2 {
+			return FormatError("bad tRNS length")
+		}
+		n, err := io.ReadFull(d.r, d.tmp[:length])
+		if err != nil {
+			return err
+		}
+		d.crc.Write(d.tmp[:n])
+
+		copy(d.transparent[:], d.tmp[:length])
+		switch d.cb {
+		case cbG1:
+			d.transparent[1] *= 0xff
+		case cbG2:
+			d.transparent[1] *= 0x55
+		case cbG4:
+			d.transparent[1] *= 0x11
+		}
+		d.useTransparent = true
+
+	case cbTC8, cbTC16:
+		if length != 6 {
+			return FormatError("bad tRNS length")
+		}
+		n, err := io.ReadFull(d.r, d.tmp[:length])
+		if err != nil {
+			return err
+		}
+		d.crc.Write(d.tmp[:n])
+
+		copy(d.transparent[:], d.tmp[:length])
+		d.useTransparent = true
+
+	case cbP1, cbP2, cbP4, cbP8:
+		if length > 256 {
+			return FormatError("bad tRNS length")
+		}
+		n, err := io.ReadFull(d.r, d.tmp[:length])
+		if err != nil {
+			return err
+		}
+		d.crc.Write(d.tmp[:n])
+
+		if len(d.palette) < n {
+			d.palette = d.palette[:n]
+		}
+		for i := 0; i < n; i++ {
+			rgba := d.palette[i].(color.RGBA)
+			d.palette[i] = color.NRGBA{rgba.R, rgba.G, rgba.B, d.tmp[i]}
+		}
+
+	default:
+		return FormatError("tRNS, color type mismatch")
+	}
+	return d.verifyChecksum()
+}
+
 // Read presents one or more IDAT chunks as one continuous stream (minus the
 // intermediate chunk headers and footers). If the PNG data looked like:
-//   ... len0 IDAT xxx crc0 len1 IDAT yy crc1 len2 IEND crc2
+//
+//	... len0 IDAT xxx crc0 len1 IDAT yy crc1 len2 IEND crc2
+//
 // then this reader presents xxxyy. For well-formed PNG data, the decoder state
 // immediately before the first Read call is that d.r is positioned between the
 // first IDAT and xxx, and the decoder state immediately after the last Read
@@ -0,0 +1,502 @@
+package png
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"sync"
+)
+
+// A CompressionLevel indicates the compression level to use when encoding.
+type CompressionLevel int
+
+const (
+	DefaultCompression CompressionLevel = 0
+	NoCompression      CompressionLevel = -1
+	BestSpeed          CompressionLevel = -2
+	BestCompression    CompressionLevel = -3
+)
+
+// zlibLevel maps a CompressionLevel onto the compress/zlib constant it
+// corresponds to.
+func (l CompressionLevel) zlibLevel() int {
+	switch l {
+	case NoCompression:
+		return zlib.NoCompression
+	case BestSpeed:
+		return zlib.BestSpeed
+	case BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
+}
+
+// defaultIDATSize is the size, in compressed bytes, at which a RowEncoder
+// flushes an IDAT chunk.
+const defaultIDATSize = 32 * 1024
+
+// An EncoderOption configures optional behavior of NewEncoder.
+type EncoderOption func(*encoderOptions)
+
+type encoderOptions struct {
+	parallelism int
+}
+
+// Parallelism sets the number of worker goroutines Encode uses to pick each
+// row's filter type concurrently; a value of 0 or 1 (the default) filters
+// rows sequentially on the calling goroutine. Since Encode already holds
+// the whole image in memory, a worker only ever reads img's raw pixel
+// bytes, never another worker's output, so the result is byte-for-byte the
+// same as the sequential path regardless of parallelism.
+func Parallelism(n int) EncoderOption {
+	return func(o *encoderOptions) { o.parallelism = n }
+}
+
+// An Encoder writes image.NRGBA images as 8-bit truecolor-with-alpha PNGs.
+// It streams rows through a RowEncoder internally, so its own memory use is
+// O(width) rather than O(width*height), unless Parallelism is set, in which
+// case it also holds one in-flight filtered row per worker.
+type Encoder struct {
+	level CompressionLevel
+	o     encoderOptions
+}
+
+// NewEncoder returns an Encoder that compresses at the given level.
+func NewEncoder(level CompressionLevel, opts ...EncoderOption) *Encoder {
+	enc := &Encoder{level: level}
+	for _, opt := range opts {
+		opt(&enc.o)
+	}
+	return enc
+}
+
+// Encode writes img to w as a PNG image.
+func (enc *Encoder) Encode(w io.Writer, img *image.NRGBA) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	re, err := NewRowEncoder(w, width, height, WithCompressionLevel(enc.level))
+	if err != nil {
+		return err
+	}
+	if enc.o.parallelism > 1 {
+		if err := enc.encodeParallel(re, img); err != nil {
+			return err
+		}
+	} else {
+		for y := 0; y < height; y++ {
+			o := img.PixOffset(b.Min.X, b.Min.Y+y)
+			if err := re.WriteRow(img.Pix[o : o+width*4]); err != nil {
+				return err
+			}
+		}
+	}
+	return re.Close()
+}
+
+// encodeParallel fills re by picking each row's filter type across
+// enc.o.parallelism worker goroutines, then serializing the winning
+// filtered bytes to the IDAT stream in row order through a reorder buffer
+// keyed by row index, so the output is identical to the sequential path.
+func (enc *Encoder) encodeParallel(re *RowEncoder, img *image.NRGBA) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	rowSize := 1 + width*4
+	zero := make([]uint8, width*4)
+
+	rawRow := func(y int) []uint8 {
+		if y < 0 {
+			return zero
+		}
+		o := img.PixOffset(b.Min.X, b.Min.Y+y)
+		return img.Pix[o : o+width*4]
+	}
+
+	type result struct {
+		y    int
+		data []uint8
+	}
+	rows := make(chan int)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	wg.Add(enc.o.parallelism)
+	for i := 0; i < enc.o.parallelism; i++ {
+		go func() {
+			defer wg.Done()
+			var cr [nFilter][]uint8
+			for f := range cr {
+				cr[f] = make([]uint8, rowSize)
+				cr[f][0] = uint8(f)
+			}
+			for y := range rows {
+				copy(cr[ftNone][1:], rawRow(y))
+				filterCandidates(&cr, rawRow(y-1))
+				f := chooseFilter(&cr)
+				data := make([]uint8, rowSize)
+				copy(data, cr[f])
+				results <- result{y: y, data: data}
+			}
+		}()
+	}
+	go func() {
+		for y := 0; y < height; y++ {
+			rows <- y
+		}
+		close(rows)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int][]uint8, enc.o.parallelism)
+	next := 0
+	var writeErr error
+	for r := range results {
+		pending[r.y] = r.data
+		for {
+			data, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if writeErr == nil {
+				writeErr = re.writeFilteredRow(data)
+			}
+			next++
+		}
+	}
+	return writeErr
+}
+
+// A RowEncoderOption configures optional behavior of NewRowEncoder.
+type RowEncoderOption func(*rowEncoderOptions)
+
+type rowEncoderOptions struct {
+	level    CompressionLevel
+	idatSize int
+
+	gamma      *float64
+	chroma     *Chromaticities
+	iccName    string
+	iccProfile []byte
+	phys       *PhysicalPixelDimensions
+	exif       []byte
+	text       []TextEntry
+}
+
+// WithCompressionLevel sets the zlib compression level used for IDAT data.
+// The default is DefaultCompression.
+func WithCompressionLevel(level CompressionLevel) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.level = level }
+}
+
+// WithIDATSize sets the size, in compressed bytes, at which a RowEncoder
+// flushes an IDAT chunk. The default is 32KiB; callers streaming to a slow
+// writer may want it larger to cut down on chunk overhead.
+func WithIDATSize(n int) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.idatSize = n }
+}
+
+// WithGamma adds a gAMA chunk recording the image's gamma.
+func WithGamma(gamma float64) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.gamma = &gamma }
+}
+
+// WithChromaticities adds a cHRM chunk recording the reference white point
+// and primary chromaticities.
+func WithChromaticities(c Chromaticities) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.chroma = &c }
+}
+
+// WithICCProfile adds an iCCP chunk embedding profile under name, which
+// must be at most 79 bytes and must not contain a null byte.
+func WithICCProfile(name string, profile []byte) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.iccName, o.iccProfile = name, profile }
+}
+
+// WithPhysicalPixelDimensions adds a pHYs chunk recording the image's
+// pixel density.
+func WithPhysicalPixelDimensions(p PhysicalPixelDimensions) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.phys = &p }
+}
+
+// WithEXIF adds an eXIf chunk with the given raw TIFF-format payload.
+func WithEXIF(data []byte) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.exif = data }
+}
+
+// WithText adds a tEXt chunk for each given entry's Keyword and Text; the
+// entry's Language and TranslatedKeyword fields, if any, are ignored, since
+// tEXt has no iTXt-style language tag.
+func WithText(entries ...TextEntry) RowEncoderOption {
+	return func(o *rowEncoderOptions) { o.text = append(o.text, entries...) }
+}
+
+// A RowEncoder is a row-by-row encoder for png image.NRGBA images,
+// mirroring Decoder.DecodeRow on the write side: WriteRow takes one row of
+// width*4 NRGBA bytes at a time, so a caller can encode a multi-gigapixel
+// image in O(width) memory instead of materializing an image.Image first.
+type RowEncoder struct {
+	w             io.Writer
+	width, height int
+	y             int
+
+	idat *idatWriter
+	zw   *zlib.Writer
+
+	// cr holds the current row filtered by every candidate filter type,
+	// cr[f][0] being the filter-type byte itself; pr is the previous row's
+	// raw (unfiltered) pixel bytes. Both are reused across calls to
+	// WriteRow instead of being reallocated per row.
+	cr [nFilter][]uint8
+	pr []uint8
+}
+
+// NewRowEncoder writes the PNG header and IHDR chunk for a width by height
+// image to w, and returns a RowEncoder ready for width*4 NRGBA rows.
+func NewRowEncoder(w io.Writer, width, height int, opts ...RowEncoderOption) (*RowEncoder, error) {
+	if width <= 0 || height <= 0 {
+		return nil, FormatError("non-positive dimension")
+	}
+
+	o := rowEncoderOptions{level: DefaultCompression, idatSize: defaultIDATSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if _, err := io.WriteString(w, pngHeader); err != nil {
+		return nil, err
+	}
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = 8                // bit depth
+	ihdr[9] = ctTrueColorAlpha // color type
+	ihdr[10] = 0               // compression method
+	ihdr[11] = 0               // filter method
+	ihdr[12] = 0               // interlace method
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+	if err := writeAncillaryChunks(w, &o); err != nil {
+		return nil, err
+	}
+
+	idat := &idatWriter{w: w, idatSize: o.idatSize}
+	zw, err := zlib.NewWriterLevel(idat, o.level.zlibLevel())
+	if err != nil {
+		return nil, err
+	}
+
+	rowSize := 1 + width*4
+	e := &RowEncoder{
+		w:      w,
+		width:  width,
+		height: height,
+		idat:   idat,
+		zw:     zw,
+		pr:     make([]uint8, rowSize),
+	}
+	for f := range e.cr {
+		e.cr[f] = make([]uint8, rowSize)
+		e.cr[f][0] = uint8(f)
+	}
+	return e, nil
+}
+
+// WriteRow writes the next row of the image, as width*4 NRGBA bytes.
+func (e *RowEncoder) WriteRow(nrgba []byte) error {
+	if e.y >= e.height {
+		return FormatError("too many rows written")
+	}
+	if len(nrgba) != e.width*4 {
+		return FormatError("wrong row length")
+	}
+
+	copy(e.cr[ftNone][1:], nrgba)
+	e.filterRow()
+	f := e.chooseFilter()
+	if _, err := e.zw.Write(e.cr[f]); err != nil {
+		return err
+	}
+
+	e.pr, e.cr[ftNone] = e.cr[ftNone], e.pr
+	e.y++
+	return nil
+}
+
+// writeFilteredRow writes a row's already-filtered bytes (the filter type
+// byte followed by width*4 filtered pixel bytes) straight to the IDAT
+// stream, advancing y. It is the low-level counterpart to WriteRow for
+// callers, such as Encoder's parallel filter pipeline, that pick the
+// filter themselves instead of using RowEncoder's own cr/pr scratch
+// buffers.
+func (e *RowEncoder) writeFilteredRow(filtered []byte) error {
+	if e.y >= e.height {
+		return FormatError("too many rows written")
+	}
+	if _, err := e.zw.Write(filtered); err != nil {
+		return err
+	}
+	e.y++
+	return nil
+}
+
+// filterRow fills cr[ftSub], cr[ftUp], cr[ftAverage] and cr[ftPaeth] from
+// the raw pixel bytes in cr[ftNone] and the previous row's raw pixel bytes
+// in pr, per the filter formulas in the PNG spec.
+func (e *RowEncoder) filterRow() {
+	filterCandidates(&e.cr, e.pr[1:])
+}
+
+// filterCandidates fills cr[ftSub], cr[ftUp], cr[ftAverage] and cr[ftPaeth]
+// from the raw pixel bytes already in cr[ftNone][1:] and the previous row's
+// raw pixel bytes in pdat, per the filter formulas in the PNG spec. It is a
+// free function, rather than a RowEncoder method, so Encoder's parallel
+// filter pipeline can run it concurrently against per-worker cr buffers.
+func filterCandidates(cr *[nFilter][]uint8, pdat []uint8) {
+	const bpp = 4
+	cdat := cr[ftNone][1:]
+
+	sub := cr[ftSub][1:]
+	copy(sub[:bpp], cdat[:bpp])
+	for i := bpp; i < len(cdat); i++ {
+		sub[i] = cdat[i] - cdat[i-bpp]
+	}
+
+	up := cr[ftUp][1:]
+	for i, c := range cdat {
+		up[i] = c - pdat[i]
+	}
+
+	avg := cr[ftAverage][1:]
+	for i := 0; i < bpp; i++ {
+		avg[i] = cdat[i] - pdat[i]/2
+	}
+	for i := bpp; i < len(cdat); i++ {
+		avg[i] = cdat[i] - uint8((int(cdat[i-bpp])+int(pdat[i]))/2)
+	}
+
+	paeth := cr[ftPaeth][1:]
+	for i := 0; i < bpp; i++ {
+		paeth[i] = cdat[i] - paethPredictor(0, pdat[i], 0)
+	}
+	for i := bpp; i < len(cdat); i++ {
+		paeth[i] = cdat[i] - paethPredictor(cdat[i-bpp], pdat[i], pdat[i-bpp])
+	}
+}
+
+// chooseFilter picks the filter type whose filtered bytes have the smallest
+// sum of absolute values (treating each byte as signed), the same
+// heuristic the standard library's PNG encoder uses.
+func (e *RowEncoder) chooseFilter() int {
+	return chooseFilter(&e.cr)
+}
+
+// chooseFilter is the free-function counterpart of RowEncoder.chooseFilter,
+// usable against a standalone cr buffer from Encoder's parallel pipeline.
+func chooseFilter(cr *[nFilter][]uint8) int {
+	best, bestSum := ftNone, sumAbs(cr[ftNone][1:])
+	for f := ftSub; f <= ftPaeth; f++ {
+		if sum := sumAbs(cr[f][1:]); sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return best
+}
+
+// sumAbs sums the bytes of b, treating each as a signed value, as a cheap
+// proxy for how compressible a candidate-filtered row is.
+func sumAbs(b []uint8) int {
+	sum := 0
+	for _, v := range b {
+		if v >= 128 {
+			sum += 256 - int(v)
+		} else {
+			sum += int(v)
+		}
+	}
+	return sum
+}
+
+// Close flushes the remaining compressed data as a final IDAT chunk and
+// writes the IEND chunk. It returns an error if fewer than height rows were
+// written.
+func (e *RowEncoder) Close() error {
+	if e.y != e.height {
+		return FormatError("not enough rows written")
+	}
+	if err := e.zw.Close(); err != nil {
+		return err
+	}
+	if err := e.idat.Flush(); err != nil {
+		return err
+	}
+	return writeChunk(e.w, "IEND", nil)
+}
+
+// An idatWriter buffers compressed bytes and flushes them as complete IDAT
+// chunks once idatSize bytes have accumulated, bounding a RowEncoder's
+// pending output regardless of image size.
+type idatWriter struct {
+	w        io.Writer
+	buf      bytes.Buffer
+	idatSize int
+}
+
+func (iw *idatWriter) Write(p []byte) (int, error) {
+	n, _ := iw.buf.Write(p) // bytes.Buffer.Write never errors.
+	for iw.buf.Len() >= iw.idatSize {
+		if err := iw.flushChunk(iw.idatSize); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes out any buffered bytes as a final, possibly short, IDAT
+// chunk.
+func (iw *idatWriter) Flush() error {
+	return iw.flushChunk(iw.buf.Len())
+}
+
+func (iw *idatWriter) flushChunk(n int) error {
+	if n == 0 {
+		return nil
+	}
+	return writeChunk(iw.w, "IDAT", iw.buf.Next(n))
+}
+
+// writeChunk writes a length-prefixed, CRC-suffixed PNG chunk of the given
+// type to w.
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+
+	if _, err := io.WriteString(w, typ); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	var crcb [4]byte
+	binary.BigEndian.PutUint32(crcb[:], crc.Sum32())
+	_, err := w.Write(crcb[:])
+	return err
+}